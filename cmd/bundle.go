@@ -0,0 +1,34 @@
+/*
+Copyright © 2024 Alexey Shulutkov <github@shulutkov.ru>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+)
+
+// bundleCmd represents the bundle command
+var bundleCmd = &cobra.Command{
+	Use:   "bundle",
+	Short: "Manage offline bundles of artifacts",
+	Long: "Manage offline bundles of artifacts. A bundle is a tar archive with " +
+		"Kubernetes binaries, etcd, CoreDNS, their checksums, verified signatures and a manifest, " +
+		"it's used to install clusters without access to the internet.",
+}
+
+func init() {
+	rootCmd.AddCommand(bundleCmd)
+}
@@ -0,0 +1,88 @@
+/*
+Copyright © 2024 Alexey Shulutkov <github@shulutkov.ru>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/ks-tool/k8s-bootstrapper/pkg/file-proxy"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// bundleCreateCmd represents the bundle create command
+var bundleCreateCmd = &cobra.Command{
+	Use:   "create",
+	Short: "Package artifacts into a bundle",
+	Long: "Package artifacts into a bundle. Missing artifacts are downloaded into " +
+		"the file proxy cache first, versions default to the versions defined in the config.",
+	Run: func(cmd *cobra.Command, args []string) {
+		logger := logrus.New()
+		cfg, err := readConfig(cmd)
+		if err != nil {
+			logger.Fatal(err)
+		}
+
+		proxy, err := fileproxy.NewProxy(cfg, logger)
+		if err != nil {
+			logger.Fatal(err)
+		}
+
+		endpoints, err := fileproxy.DefaultEndpoints(cfg, logger)
+		if err != nil {
+			logger.Fatal(err)
+		}
+
+		flags := cmd.Flags()
+		output, _ := flags.GetString("output")
+		concurrency, _ := flags.GetInt("concurrency")
+
+		artifacts := artifactsFromFlags(cmd, cfg)
+		if !prefetch(cmd, proxy, endpoints, artifacts, concurrency) {
+			os.Exit(1)
+		}
+
+		f, err := os.CreateTemp(filepath.Dir(output), "."+filepath.Base(output)+".*")
+		if err != nil {
+			logger.Fatal(err)
+		}
+		defer func() { _ = os.Remove(f.Name()) }()
+
+		if err = proxy.ExportBundle(f, artifacts); err != nil {
+			_ = f.Close()
+			logger.Fatal(err)
+		}
+		if err = f.Close(); err != nil {
+			logger.Fatal(err)
+		}
+		if err = os.Rename(f.Name(), output); err != nil {
+			logger.Fatal(err)
+		}
+
+		cmd.Printf("bundle %s created with %d artifacts\n", output, len(artifacts))
+	},
+}
+
+func init() {
+	flags := bundleCreateCmd.Flags()
+	addArtifactFlags(flags)
+	flags.StringP("output", "o", "bundle.tar", "path to the bundle file")
+	flags.Int("concurrency", 4, "maximum number of parallel downloads")
+	bundleCmd.AddCommand(bundleCreateCmd)
+}
@@ -0,0 +1,63 @@
+/*
+Copyright © 2024 Alexey Shulutkov <github@shulutkov.ru>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"os"
+
+	"github.com/ks-tool/k8s-bootstrapper/pkg/file-proxy"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// bundleImportCmd represents the bundle import command
+var bundleImportCmd = &cobra.Command{
+	Use:   "import <bundle.tar>",
+	Short: "Load artifacts of a bundle into the file proxy cache",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		logger := logrus.New()
+		cfg, err := readConfig(cmd)
+		if err != nil {
+			logger.Fatal(err)
+		}
+
+		proxy, err := fileproxy.NewProxy(cfg, logger)
+		if err != nil {
+			logger.Fatal(err)
+		}
+
+		f, err := os.Open(args[0])
+		if err != nil {
+			logger.Fatal(err)
+		}
+		defer func() { _ = f.Close() }()
+
+		imported, err := proxy.ImportBundle(f)
+		for _, a := range imported {
+			cmd.Printf("imported %s\n", a)
+		}
+		if err != nil {
+			logger.Fatal(err)
+		}
+	},
+}
+
+func init() {
+	bundleCmd.AddCommand(bundleImportCmd)
+}
@@ -17,14 +17,19 @@ limitations under the License.
 package cmd
 
 import (
+	"fmt"
 	"os"
 
+	"github.com/ks-tool/k8s-bootstrapper/internal/config"
 	"github.com/ks-tool/k8s-bootstrapper/internal/tasks/download"
 	"github.com/ks-tool/k8s-bootstrapper/internal/tasks/kubeconfig"
 	"github.com/ks-tool/k8s-bootstrapper/internal/tasks/pki"
 	"github.com/ks-tool/k8s-bootstrapper/internal/tasks/preflight"
 	"github.com/ks-tool/k8s-bootstrapper/internal/tasks/systemd"
+	"github.com/ks-tool/k8s-bootstrapper/pkg/fetch"
+	"github.com/ks-tool/k8s-bootstrapper/pkg/file-proxy"
 	"github.com/ks-tool/k8s-bootstrapper/pkg/flow"
+	"github.com/ks-tool/k8s-bootstrapper/pkg/signature"
 
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
@@ -41,6 +46,14 @@ var initCmd = &cobra.Command{
 			logger.Fatal(err)
 		}
 
+		bundleFile, _ := cmd.Flags().GetString("bundle")
+		installProxy, _ := cmd.Flags().GetBool("install-proxy")
+		src, err := newNodeSources(cfg, bundleFile, !installProxy, logger)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		defer src.close()
+
 		initFlow := flow.New()
 
 		preflightTask := flow.NewTask("preflight")
@@ -53,15 +66,25 @@ var initCmd = &cobra.Command{
 		preflightTask.AddAction(preflight.DirectoryKubernetes)
 		preflightTask.AddAction(preflight.DirectoryKubernetesPKI)
 		preflightTask.AddAction(preflight.DirectoryAssets(cfg))
+		if len(bundleFile) == 0 {
+			if installProxy {
+				act, err := ensureProxyService(cmd, cfg)
+				if err != nil {
+					src.close()
+					logger.Fatal(err)
+				}
+				preflightTask.AddAction(act)
+			}
+			preflightTask.AddAction(preflight.FileProxyReachable(src.client, src.proxy.pfx))
+		}
 		initFlow.AddTask(preflightTask)
 
 		downloadTask := flow.NewTask("download")
-		urlPfx := newProxyUrl(cfg)
-		downloadTask.AddAction(download.Etcd(urlPfx.etcd()))
-		downloadTask.AddAction(download.KubeApiserver(urlPfx.kube("kube-apiserver")))
-		downloadTask.AddAction(download.KubeControllerManager(urlPfx.kube("kube-controller-manager")))
-		downloadTask.AddAction(download.KubeScheduler(urlPfx.kube("kube-scheduler")))
-		downloadTask.AddAction(download.Coredns(urlPfx.coredns()))
+		downloadTask.AddAction(download.Etcd(src.etcd()))
+		downloadTask.AddAction(download.KubeApiserver(src.kube("kube-apiserver")))
+		downloadTask.AddAction(download.KubeControllerManager(src.kube("kube-controller-manager")))
+		downloadTask.AddAction(download.KubeScheduler(src.kube("kube-scheduler")))
+		downloadTask.AddAction(download.Coredns(src.coredns()))
 		initFlow.AddTask(downloadTask)
 
 		pkiTask := flow.NewTask("pki")
@@ -100,11 +123,124 @@ var initCmd = &cobra.Command{
 
 		if err := initFlow.Run(cmd.Context()); err != nil {
 			cmd.PrintErr(err)
+			src.close()
 			os.Exit(1)
 		}
 	},
 }
 
 func init() {
+	initCmd.Flags().String("bundle", "", "install artifacts from the bundle file instead of the file proxy")
+	initCmd.Flags().Bool("install-proxy", false, "install and start the file proxy service unless the proxy is already running")
 	rootCmd.AddCommand(initCmd)
 }
+
+// nodeSources are download sources of artifacts for the platform of this node,
+// artifacts are read from the bundle if it's opened or downloaded from the file proxy otherwise
+type nodeSources struct {
+	cfg      *config.Config
+	proxy    proxyUrl
+	client   *fetch.Client
+	embedded *embeddedProxy
+	peers    *peerServer
+	bundle   *fileproxy.Bundle
+	checkers map[string]*signature.Checker
+}
+
+// newNodeSources returns sources of artifacts, the embedded proxy is started if embed is set
+// and no file proxy is listening
+func newNodeSources(cfg *config.Config, bundleFile string, embed bool, log *logrus.Logger) (*nodeSources, error) {
+	s := &nodeSources{cfg: cfg, proxy: newProxyUrl(cfg), checkers: make(map[string]*signature.Checker)}
+
+	if len(bundleFile) == 0 {
+		if embed && !proxyListening(cfg) {
+			e, err := startEmbeddedProxy(cfg, log)
+			if err != nil {
+				return nil, fmt.Errorf("embedded proxy: %v", err)
+			}
+			s.embedded = e
+			s.proxy.pfx = e.url
+			s.client = fetch.NewClient(fetch.DefaultClientOptions)
+		} else {
+			opts := fetch.DefaultClientOptions
+			if cfg.Proxy.Peers.Enabled {
+				opts.Peers = newPeers(cfg, s.proxy)
+			}
+			client, err := newProxyClient(cfg, opts)
+			if err != nil {
+				return nil, err
+			}
+			s.client = client
+
+			if opts.Peers != nil {
+				if s.peers, err = startPeerServer(cfg, client, opts.Peers, log); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	for _, key := range []string{fileproxy.KubernetesEndpoint, "etcd", "coredns"} {
+		c, err := signature.NewChecker(cfg.Proxy.Signatures[key], log)
+		if err != nil {
+			s.close()
+			return nil, fmt.Errorf("signatures of %q: %v", key, err)
+		}
+		s.checkers[key] = c
+	}
+
+	if len(bundleFile) == 0 {
+		return s, nil
+	}
+
+	b, err := fileproxy.OpenBundle(bundleFile)
+	if err != nil {
+		s.close()
+		return nil, err
+	}
+	s.bundle = b
+
+	return s, nil
+}
+
+func (s *nodeSources) etcd() download.Source {
+	return s.source("etcd", "etcd", s.cfg.ControlPlain.EtcdVersion)
+}
+
+func (s *nodeSources) coredns() download.Source {
+	return s.source("coredns", "coredns", s.cfg.ControlPlain.CorednsVersion)
+}
+
+func (s *nodeSources) kube(name string) download.Source {
+	return s.source(fileproxy.KubernetesEndpoint, name, s.cfg.ControlPlain.KubernetesVersion)
+}
+
+// source returns the source of the artifact verified by signature settings of the endpoint,
+// artifacts of the bundle are also verified by checksums of its manifest
+func (s *nodeSources) source(endpoint, name, version string) download.Source {
+	if s.bundle != nil {
+		return download.Bundle(s.bundle, nodeArtifact(name, version), s.checkers[endpoint])
+	}
+
+	return download.SignedURL(
+		s.client,
+		s.proxy.url(name, version),
+		s.proxy.url(name, version+".sig"),
+		s.proxy.url(name, version+".cert"),
+		s.checkers[endpoint],
+	)
+}
+
+func (s *nodeSources) close() {
+	if s.bundle != nil {
+		_ = s.bundle.Close()
+	}
+	if s.embedded != nil {
+		s.embedded.close()
+		s.embedded = nil
+	}
+	if s.peers != nil {
+		s.peers.close()
+		s.peers = nil
+	}
+}
@@ -0,0 +1,150 @@
+/*
+Copyright © 2024 Alexey Shulutkov <github@shulutkov.ru>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/ks-tool/k8s-bootstrapper/internal/config"
+	"github.com/ks-tool/k8s-bootstrapper/pkg/fetch"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// peerCmd represents the peer command
+var peerCmd = &cobra.Command{
+	Use:   "peer",
+	Short: "Share artifacts downloaded by this node with other nodes",
+	Run: func(cmd *cobra.Command, args []string) {
+		logger := logrus.New()
+		cfg, err := readConfig(cmd)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		if !cfg.Proxy.Peers.Enabled {
+			logger.Fatal("sharing of artifacts is disabled, see proxy.peers.enabled")
+		}
+
+		opts := fetch.DefaultClientOptions
+		opts.Peers = newPeers(cfg, newProxyUrl(cfg))
+		client, err := newProxyClient(cfg, opts)
+		if err != nil {
+			logger.Fatal(err)
+		}
+
+		srv, err := startPeerServer(cfg, client, opts.Peers, logger)
+		if err != nil {
+			logger.Fatal(err)
+		}
+
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT)
+
+		<-sig
+		srv.close()
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(peerCmd)
+}
+
+// newPeers returns peers discovered by the proxy, this node serves kept artifacts on its advertise address
+func newPeers(cfg *config.Config, proxy proxyUrl) *fetch.Peers {
+	s := cfg.Proxy.Peers
+	return fetch.NewPeers(fetch.PeerOptions{
+		DiscoveryURL: proxy.pfx + "/_peers",
+		URL:          "http://" + peerAddr(cfg),
+		Dir:          s.Dir,
+		ChunkSize:    s.ChunkSize,
+		Concurrency:  s.Concurrency,
+	})
+}
+
+func peerAddr(cfg *config.Config) string {
+	return net.JoinHostPort(cfg.ControlPlain.LocalAPIEndpoint.AdvertiseAddress.String(), fmt.Sprint(cfg.Proxy.Peers.Port))
+}
+
+// peerServer serves artifacts of this node to peers while it's announced to the proxy
+type peerServer struct {
+	srv  *http.Server
+	stop context.CancelFunc
+	done chan struct{}
+	log  logrus.FieldLogger
+}
+
+func startPeerServer(cfg *config.Config, client *fetch.Client, peers *fetch.Peers, logger *logrus.Logger) (*peerServer, error) {
+	ln, err := net.Listen("tcp", peerAddr(cfg))
+	if err != nil {
+		return nil, fmt.Errorf("share artifacts: %v", err)
+	}
+
+	w := logger.Writer()
+	s := &peerServer{
+		srv: &http.Server{
+			Handler:  peers.Handler(),
+			ErrorLog: log.New(w, "peer: ", 0),
+		},
+		done: make(chan struct{}),
+		log:  logger,
+	}
+	s.srv.RegisterOnShutdown(func() { _ = w.Close() })
+
+	go func() {
+		if err := s.srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error(err)
+		}
+	}()
+
+	ctx, stop := context.WithCancel(context.Background())
+	ctx = fetch.ContextWithProgress(ctx, func(p fetch.Progress) {
+		if p.Err != nil {
+			logger.Warn(p)
+		}
+	})
+	s.stop = stop
+	go func() {
+		defer close(s.done)
+		client.Announce(ctx, cfg.Proxy.Peers.TTL.Duration/3)
+	}()
+	logger.Infof("sharing artifacts with peers on %s", ln.Addr())
+
+	return s, nil
+}
+
+// close withdraws the node from the proxy and stops serving peers
+func (s *peerServer) close() {
+	s.stop()
+	<-s.done
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	if err := s.srv.Shutdown(ctx); err != nil {
+		s.log.Warnf("shutdown peer server: %v", err)
+	}
+}
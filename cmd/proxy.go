@@ -21,13 +21,17 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"runtime"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/ks-tool/k8s-bootstrapper/internal/config"
+	"github.com/ks-tool/k8s-bootstrapper/pkg/fetch"
 	"github.com/ks-tool/k8s-bootstrapper/pkg/file-proxy"
 
 	"github.com/sirupsen/logrus"
@@ -45,55 +49,80 @@ var proxyCmd = &cobra.Command{
 			logger.Fatal(err)
 		}
 
-		mux := http.NewServeMux()
-		proxy := fileproxy.NewProxy(cfg)
-		mux.HandleFunc("/coredns/", proxy.Handler(fileproxy.Github{
-			Owner: "coredns",
-			Repo:  "coredns",
-			File: func(v string) string {
-				if v[0] == 'v' {
-					v = v[1:]
-				}
-				return fmt.Sprintf("coredns_%s_linux_amd64.tgz", v)
-			},
-			HashFile: func(v string) string {
-				if v[0] == 'v' {
-					v = v[1:]
-				}
-				return fmt.Sprintf("coredns_%s_linux_amd64.tgz.sha256", v)
-			},
-		}))
+		proxy, err := fileproxy.NewProxy(cfg, logger)
+		if err != nil {
+			logger.Fatal(err)
+		}
+
+		if err = proxy.PrepareCache(); err != nil {
+			logger.Fatal(err)
+		}
+
+		mux, err := newProxyMux(cfg, proxy, logger)
+		if err != nil {
+			logger.Fatal(err)
+		}
 
-		mux.HandleFunc("/etcd/", proxy.Handler(fileproxy.Github{
-			Owner: "etcd-io",
-			Repo:  "etcd",
-			File: func(v string) string {
-				return fmt.Sprintf("etcd-%s-linux-amd64.tar.gz", v)
-			},
-			HashFile: func(string) string { return "SHA256SUMS" },
-		}))
+		if cfg.Proxy.Registry.Enabled {
+			registry, err := fileproxy.NewRegistry(proxy, cfg.Proxy.Registry)
+			if err != nil {
+				logger.Fatal(err)
+			}
+			mux.Handle("/v2/", registry)
+		}
 
-		mux.HandleFunc("/", proxy.Handler(fileproxy.Kube))
+		if cfg.Proxy.Peers.Enabled {
+			mux.Handle("/_peers", fileproxy.NewPeers(cfg.Proxy.Peers.TTL.Duration))
+		}
+
+		access, err := fileproxy.NewAccess(cfg.Proxy.Access, logger)
+		if err != nil {
+			logger.Fatal(err)
+		}
 
 		w := logger.Writer()
 		defer func() { _ = w.Close() }()
 
+		tlsCfg, err := proxyServerTLS(cfg)
+		if err != nil {
+			logger.Fatal(err)
+		}
+
+		listeners, err := proxyListeners(cfg.Proxy.Listen)
+		if err != nil {
+			logger.Fatal(err)
+		}
+
 		srv := &http.Server{
-			Addr:     fmt.Sprintf("%s:%d", cfg.ControlPlain.LocalAPIEndpoint.AdvertiseAddress, cfg.ProxyPort),
-			Handler:  mux,
-			ErrorLog: log.New(w, "proxy: ", 0),
+			Handler:   access.Middleware(mux),
+			ErrorLog:  log.New(w, "proxy: ", 0),
+			TLSConfig: tlsCfg,
 		}
 
-		go func() {
-			if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
-				logger.Fatal(err)
-			}
-		}()
+		for _, ln := range listeners {
+			go func() {
+				var err error
+				if tlsCfg != nil {
+					err = srv.ServeTLS(ln, "", "")
+				} else {
+					err = srv.Serve(ln)
+				}
+				if err != nil && !errors.Is(err, http.ErrServerClosed) {
+					logger.Fatal(err)
+				}
+			}()
+			logger.Infof("file proxy listens on %s", ln.Addr())
+		}
+
+		gcCtx, stopGC := context.WithCancel(cmd.Context())
+		defer stopGC()
+		go proxy.RunGC(gcCtx, cfg.Proxy.Cache.GCInterval.Duration)
 
 		sig := make(chan os.Signal, 1)
 		signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT)
 
 		<-sig
+		stopGC()
 
 		func() {
 			srv.SetKeepAlivesEnabled(false)
@@ -112,32 +141,124 @@ func init() {
 	rootCmd.AddCommand(proxyCmd)
 }
 
-const urlFmt = "%s/%s/%s"
+// newProxyMux returns the mux serving artifacts of default endpoints, the catalog, metrics and health checks
+func newProxyMux(cfg *config.Config, proxy *fileproxy.Proxy, log logrus.FieldLogger) (*http.ServeMux, error) {
+	endpoints, err := fileproxy.DefaultEndpoints(cfg, log)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	endpoints.Register(mux, proxy)
+	mux.Handle("/_catalog", proxy.CatalogHandler())
+	mux.Handle("/metrics", proxy.MetricsHandler())
+	mux.HandleFunc("/healthz", fileproxy.HealthzHandler)
+	mux.Handle("/readyz", proxy.ReadyzHandler())
+
+	return mux, nil
+}
+
+// proxyListeners listens on addresses of the proxy, unix:<path> is a unix socket accessible to the group
+// of the proxy, the stale socket of the previous run is replaced
+func proxyListeners(addrs []string) ([]net.Listener, error) {
+	listeners := make([]net.Listener, 0, len(addrs))
+	closeAll := func() {
+		for _, ln := range listeners {
+			_ = ln.Close()
+		}
+	}
+
+	for _, addr := range addrs {
+		ln, err := proxyListen(addr)
+		if err != nil {
+			closeAll()
+			return nil, fmt.Errorf("listen %s: %v", addr, err)
+		}
+		listeners = append(listeners, ln)
+	}
+
+	return listeners, nil
+}
+
+func proxyListen(addr string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, "unix:")
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err = os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.Chmod(path, 0660); err != nil {
+		_ = ln.Close()
+		return nil, err
+	}
+
+	return ln, nil
+}
 
 type proxyUrl struct {
 	pfx string
 	cfg *config.Config
 }
 
+// newProxyUrl returns download URLs of artifacts under the public URL of the proxy
 func newProxyUrl(cfg *config.Config) proxyUrl {
-	return proxyUrl{
-		pfx: fmt.Sprintf(
-			"http://%s:%d",
-			cfg.ControlPlain.LocalAPIEndpoint.AdvertiseAddress,
-			cfg.ProxyPort,
-		),
-		cfg: cfg,
+	return proxyUrl{pfx: cfg.Proxy.PublicURL, cfg: cfg}
+}
+
+// url returns the download URL of the artifact for the platform of this node
+func (p proxyUrl) url(name, version string) string {
+	u := fmt.Sprintf("%s/%s/%s", p.pfx, name, version)
+	if q := nodeArtifact(name, version).Query(); len(q) > 0 {
+		u += "?" + q.Encode()
 	}
+
+	return u
 }
 
-func (p proxyUrl) etcd() string {
-	return fmt.Sprintf(urlFmt, p.pfx, "etcd", p.cfg.ControlPlain.EtcdVersion)
+// newProxyClient returns the client of nodes downloading from the proxy, it presents the client certificate
+// and the token if the proxy restricts access
+func newProxyClient(cfg *config.Config, opts fetch.ClientOptions) (*fetch.Client, error) {
+	tlsCfg, err := proxyClientTLS(cfg)
+	if err != nil {
+		return nil, err
+	}
+	token, err := proxyClientToken(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	opts.TLS = tlsCfg
+	opts.Token = token
+
+	return fetch.NewClient(opts), nil
 }
 
-func (p proxyUrl) coredns() string {
-	return fmt.Sprintf(urlFmt, p.pfx, "coredns", p.cfg.ControlPlain.CorednsVersion)
+// proxyClientToken returns the bearer token presented by nodes to the proxy restricting access
+func proxyClientToken(cfg *config.Config) (string, error) {
+	access := cfg.Proxy.Access
+	if len(access.Tokens) > 0 {
+		return access.Tokens[0], nil
+	}
+	if len(access.TokenFile) > 0 {
+		return fileproxy.ReadTokenFile(access.TokenFile)
+	}
+
+	return "", nil
 }
 
-func (p proxyUrl) kube(name string) string {
-	return fmt.Sprintf(urlFmt, p.pfx, name, p.cfg.ControlPlain.KubernetesVersion)
+// nodeArtifact returns the artifact for the platform of this node
+func nodeArtifact(name, version string) fileproxy.Artifact {
+	return fileproxy.Artifact{Name: name, Version: version, OS: runtime.GOOS, Arch: runtime.GOARCH}
 }
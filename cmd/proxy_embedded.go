@@ -0,0 +1,107 @@
+/*
+Copyright © 2024 Alexey Shulutkov <github@shulutkov.ru>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/ks-tool/k8s-bootstrapper/internal/config"
+	"github.com/ks-tool/k8s-bootstrapper/pkg/file-proxy"
+
+	"github.com/sirupsen/logrus"
+)
+
+// embeddedProxy serves downloads of init on a loopback ephemeral port when no file proxy is listening
+type embeddedProxy struct {
+	srv *http.Server
+	url string
+	log logrus.FieldLogger
+}
+
+// proxyListening reports whether anything accepts connections on the host of the public URL of the file proxy
+func proxyListening(cfg *config.Config) bool {
+	u, err := url.Parse(cfg.Proxy.PublicURL)
+	if err != nil {
+		return false
+	}
+
+	port := u.Port()
+	if len(port) == 0 {
+		port = u.Scheme
+	}
+
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(u.Hostname(), port), 2*time.Second)
+	if err != nil {
+		return false
+	}
+	_ = conn.Close()
+
+	return true
+}
+
+// startEmbeddedProxy starts the proxy sharing endpoints and the cache directory with the proxy command
+func startEmbeddedProxy(cfg *config.Config, logger *logrus.Logger) (*embeddedProxy, error) {
+	proxy, err := fileproxy.NewProxy(cfg, logger)
+	if err != nil {
+		return nil, err
+	}
+	if err = proxy.PrepareCache(); err != nil {
+		return nil, err
+	}
+
+	mux, err := newProxyMux(cfg, proxy, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	w := logger.Writer()
+	srv := &http.Server{
+		Handler:  mux,
+		ErrorLog: log.New(w, "embedded proxy: ", 0),
+	}
+	srv.RegisterOnShutdown(func() { _ = w.Close() })
+
+	e := &embeddedProxy{srv: srv, url: "http://" + ln.Addr().String(), log: logger}
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error(err)
+		}
+	}()
+	logger.Infof("file proxy is not listening, downloading via the embedded proxy on %s", e.url)
+
+	return e, nil
+}
+
+func (e *embeddedProxy) close() {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	if err := e.srv.Shutdown(ctx); err != nil {
+		e.log.Warnf("shutdown embedded proxy: %v", err)
+	}
+}
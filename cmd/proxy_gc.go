@@ -0,0 +1,63 @@
+/*
+Copyright © 2024 Alexey Shulutkov <github@shulutkov.ru>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"github.com/ks-tool/k8s-bootstrapper/pkg/file-proxy"
+	"github.com/ks-tool/k8s-bootstrapper/utils"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// proxyGCCmd represents the proxy gc command
+var proxyGCCmd = &cobra.Command{
+	Use:   "gc",
+	Short: "Remove artifacts from the file proxy cache according to the cache policy",
+	Run: func(cmd *cobra.Command, args []string) {
+		logger := logrus.New()
+		cfg, err := readConfig(cmd)
+		if err != nil {
+			logger.Fatal(err)
+		}
+
+		proxy, err := fileproxy.NewProxy(cfg, logger)
+		if err != nil {
+			logger.Fatal(err)
+		}
+
+		dryRun, _ := cmd.Flags().GetBool("dry-run")
+		evicted, err := proxy.GC(dryRun)
+
+		action := "removed"
+		if dryRun {
+			action = "would remove"
+		}
+		for _, e := range evicted {
+			cmd.Printf("%s %s (%s): %s\n", action, e, utils.FormatSize(e.Size), e.Reason)
+		}
+
+		if err != nil {
+			logger.Fatal(err)
+		}
+	},
+}
+
+func init() {
+	proxyGCCmd.Flags().Bool("dry-run", false, "only print artifacts which would be removed")
+	proxyCmd.AddCommand(proxyGCCmd)
+}
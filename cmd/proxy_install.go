@@ -0,0 +1,278 @@
+/*
+Copyright © 2024 Alexey Shulutkov <github@shulutkov.ru>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ks-tool/k8s-bootstrapper/internal/config"
+	"github.com/ks-tool/k8s-bootstrapper/internal/tasks/preflight"
+	"github.com/ks-tool/k8s-bootstrapper/internal/tasks/systemd"
+	"github.com/ks-tool/k8s-bootstrapper/pkg/fetch"
+	"github.com/ks-tool/k8s-bootstrapper/pkg/flow"
+	sysd "github.com/ks-tool/k8s-bootstrapper/pkg/systemd"
+	"github.com/ks-tool/k8s-bootstrapper/utils"
+
+	"github.com/spf13/cobra"
+)
+
+// protectedDirs are not accessible to the proxy service because of ProtectHome
+var protectedDirs = []string{"/home", "/root", "/run/user"}
+
+// proxyInstallCmd represents the proxy install command
+var proxyInstallCmd = &cobra.Command{
+	Use:   "install",
+	Short: "Install the file proxy as a systemd service, enable and start it",
+	Run: func(cmd *cobra.Command, args []string) {
+		cfg, err := readConfig(cmd)
+		if err != nil {
+			cmd.PrintErrln(err)
+			os.Exit(1)
+		}
+
+		acts, err := proxyServiceActions(cmd, cfg)
+		if err != nil {
+			cmd.PrintErrln(err)
+			os.Exit(1)
+		}
+
+		installFlow := flow.New()
+
+		preflightTask := flow.NewTask("preflight")
+		preflightTask.AddAction(preflight.GroupKubernetes)
+		installFlow.AddTask(preflightTask)
+
+		serviceTask := flow.NewTask("file proxy")
+		for _, act := range acts {
+			serviceTask.AddAction(act)
+		}
+		installFlow.AddTask(serviceTask)
+
+		if err = installFlow.Run(cmd.Context()); err != nil {
+			cmd.PrintErr(err)
+			os.Exit(1)
+		}
+	},
+}
+
+// proxyUninstallCmd represents the proxy uninstall command
+var proxyUninstallCmd = &cobra.Command{
+	Use:   "uninstall",
+	Short: "Stop and remove the file proxy systemd service, the cache and the proxy user are kept",
+	Run: func(cmd *cobra.Command, args []string) {
+		name := config.DefaultProxyServiceName
+		if _, err := sysd.NewSystemdUnitFromUnitFile(name); os.IsNotExist(err) {
+			cmd.Printf("%s is not installed\n", name)
+			return
+		}
+
+		uninstallFlow := flow.New()
+
+		serviceTask := flow.NewTask("file proxy")
+		serviceTask.AddAction(systemd.Stop(name))
+		serviceTask.AddAction(systemd.Disable(name))
+		serviceTask.AddAction(systemd.Remove(name))
+		serviceTask.AddAction(systemd.DaemonReload)
+		uninstallFlow.AddTask(serviceTask)
+
+		if err := uninstallFlow.Run(cmd.Context()); err != nil {
+			cmd.PrintErr(err)
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	proxyCmd.AddCommand(proxyInstallCmd)
+	proxyCmd.AddCommand(proxyUninstallCmd)
+}
+
+// proxyServiceActions returns actions installing the binary and the unit of the proxy, starting it
+// and waiting until it's ready. The kubernetes group must exist.
+func proxyServiceActions(cmd *cobra.Command, cfg *config.Config) ([]flow.Action, error) {
+	configPath, _ := cmd.Flags().GetString("config")
+	if len(configPath) > 0 {
+		var err error
+		if configPath, err = filepath.Abs(configPath); err != nil {
+			return nil, err
+		}
+		if err = checkServiceAccessible("config", configPath); err != nil {
+			return nil, err
+		}
+	}
+
+	assetsDir, err := proxyServiceAssetsDir(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkServiceAccessible("assets directory", assetsDir); err != nil {
+		return nil, err
+	}
+	for _, addr := range cfg.Proxy.Listen {
+		if sock, ok := strings.CutPrefix(addr, "unix:"); ok {
+			if !filepath.IsAbs(sock) {
+				return nil, fmt.Errorf("unix socket %s of the proxy service must be an absolute path", sock)
+			}
+			if err = checkServiceAccessible("unix socket", sock); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	name := config.DefaultProxyServiceName
+	acts := []flow.Action{
+		preflight.UserFileProxy,
+		installBinary,
+		preflight.DirectoryProxyAssets(assetsDir),
+	}
+	if cfg.Proxy.TLS.Enabled {
+		acts = append(acts, proxyServiceTLS(cfg))
+	}
+
+	return append(acts,
+		systemd.FileProxy(configPath, assetsDir, cfg.Proxy.Listen),
+		systemd.DaemonReload,
+		systemd.Enable(name),
+		systemd.Restart(name),
+		waitProxyReady(cfg),
+	), nil
+}
+
+// proxyServiceAssetsDir returns the assets directory of the proxy service, "~" is the home of the proxy user
+func proxyServiceAssetsDir(cfg *config.Config) (string, error) {
+	dir := cfg.AssetsDir
+	if dir == "~" || strings.HasPrefix(dir, "~/") {
+		dir = filepath.Join(config.DefaultProxyHomeDir, dir[1:])
+	}
+
+	return filepath.Abs(dir)
+}
+
+func checkServiceAccessible(what, path string) error {
+	for _, dir := range protectedDirs {
+		if path == dir || strings.HasPrefix(path, dir+"/") {
+			return fmt.Errorf("%s %s is not accessible to the proxy service, move it out of %s", what, path, dir)
+		}
+	}
+
+	return nil
+}
+
+// installBinary copies the running binary into the bin directory, so the unit does not depend on its location
+var installBinary = flow.NewAction("install "+config.DefaultBinaryName, func(ctx context.Context) (flow.StatusType, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return flow.StatusFailed, err
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return flow.StatusFailed, err
+	}
+
+	dst := filepath.Join(config.DefaultBinDir, config.DefaultBinaryName)
+	if exe == dst {
+		return flow.StatusSkipped, nil
+	}
+
+	f, err := os.Open(exe)
+	if err != nil {
+		return flow.StatusFailed, err
+	}
+	defer func() { _ = f.Close() }()
+
+	if err = fetch.Install(dst, 0755)(f); err != nil {
+		return flow.StatusFailed, fmt.Errorf("install %s: %v", dst, err)
+	}
+
+	return flow.StatusSuccess, nil
+})
+
+// proxyServiceTLS issues the serving certificate while the CA key is accessible and passes its key
+// to the proxy user, provided certificates are kept as is
+func proxyServiceTLS(cfg *config.Config) flow.Action {
+	return flow.NewAction("file proxy certificate", func(ctx context.Context) (flow.StatusType, error) {
+		if _, err := proxyServerTLS(cfg); err != nil {
+			return flow.StatusFailed, err
+		}
+
+		s := cfg.Proxy.TLS
+		if len(s.CertFile) > 0 && len(s.KeyFile) > 0 {
+			return flow.StatusSkipped, nil
+		}
+
+		keyFile := proxyServerCertRequest(cfg).KeyFilepath()
+		if err := utils.Chown(keyFile, config.DefaultProxyUsername, config.DefaultGroupname); err != nil {
+			return flow.StatusFailed, fmt.Errorf("chown %s: %v", keyFile, err)
+		}
+
+		return flow.StatusSuccess, nil
+	})
+}
+
+// waitProxyReady waits until the proxy reports it's ready, the wait is limited by retries of the client
+func waitProxyReady(cfg *config.Config) flow.Action {
+	return flow.NewAction("wait file proxy", func(ctx context.Context) (flow.StatusType, error) {
+		opts := fetch.DefaultClientOptions
+		opts.MaxBackoff = 5 * time.Second
+		opts.Retries = 10
+
+		client, err := newProxyClient(cfg, opts)
+		if err != nil {
+			return flow.StatusFailed, err
+		}
+
+		url := newProxyUrl(cfg).pfx + "/readyz"
+		if err = client.Get(ctx, fetch.Discard, url); err != nil {
+			return flow.StatusFailed, fmt.Errorf("file proxy is not ready: %v", err)
+		}
+
+		return flow.StatusSuccess, nil
+	})
+}
+
+// ensureProxyService returns an action installing and starting the proxy service unless the proxy is ready
+func ensureProxyService(cmd *cobra.Command, cfg *config.Config) (flow.Action, error) {
+	acts, err := proxyServiceActions(cmd, cfg)
+	if err != nil {
+		return flow.Action{}, err
+	}
+
+	return flow.NewAction("file proxy", func(ctx context.Context) (flow.StatusType, error) {
+		opts := fetch.DefaultClientOptions
+		opts.Retries = 0
+
+		client, err := newProxyClient(cfg, opts)
+		if err != nil {
+			return flow.StatusFailed, err
+		}
+		if client.Get(ctx, fetch.Discard, newProxyUrl(cfg).pfx+"/readyz") == nil {
+			return flow.StatusSkipped, nil
+		}
+
+		for _, act := range acts {
+			if status, err := act.Fn(ctx); status == flow.StatusFailed {
+				return status, fmt.Errorf("%s: %v", act.Name, err)
+			}
+		}
+
+		return flow.StatusSuccess, nil
+	}), nil
+}
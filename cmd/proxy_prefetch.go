@@ -0,0 +1,135 @@
+/*
+Copyright © 2024 Alexey Shulutkov <github@shulutkov.ru>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"os"
+
+	"github.com/ks-tool/k8s-bootstrapper/internal/config"
+	"github.com/ks-tool/k8s-bootstrapper/pkg/file-proxy"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+var kubeComponents = []string{
+	"kube-apiserver",
+	"kube-controller-manager",
+	"kube-scheduler",
+	"kubelet",
+	"kube-proxy",
+	"kubectl",
+}
+
+// proxyPrefetchCmd represents the proxy prefetch command
+var proxyPrefetchCmd = &cobra.Command{
+	Use:   "prefetch",
+	Short: "Download artifacts into the file proxy cache",
+	Long: "Download artifacts into the file proxy cache. " +
+		"Versions default to the versions defined in the config.",
+	Run: func(cmd *cobra.Command, args []string) {
+		logger := logrus.New()
+		cfg, err := readConfig(cmd)
+		if err != nil {
+			logger.Fatal(err)
+		}
+
+		proxy, err := fileproxy.NewProxy(cfg, logger)
+		if err != nil {
+			logger.Fatal(err)
+		}
+
+		endpoints, err := fileproxy.DefaultEndpoints(cfg, logger)
+		if err != nil {
+			logger.Fatal(err)
+		}
+
+		concurrency, _ := cmd.Flags().GetInt("concurrency")
+		if !prefetch(cmd, proxy, endpoints, artifactsFromFlags(cmd, cfg), concurrency) {
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	flags := proxyPrefetchCmd.Flags()
+	addArtifactFlags(flags)
+	flags.Int("concurrency", 4, "maximum number of parallel downloads")
+	proxyCmd.AddCommand(proxyPrefetchCmd)
+}
+
+// prefetch downloads the artifacts into the cache and prints the results, it returns false if any download failed
+func prefetch(cmd *cobra.Command, proxy *fileproxy.Proxy, endpoints fileproxy.Endpoints, artifacts []fileproxy.Artifact, concurrency int) bool {
+	ok := true
+	for _, res := range proxy.Prefetch(cmd.Context(), endpoints, artifacts, concurrency) {
+		switch {
+		case res.Err != nil:
+			ok = false
+			cmd.Printf("failed %s: %v\n", res.Artifact, res.Err)
+		case len(res.Source) == 0:
+			cmd.Printf("cached %s\n", res.Artifact)
+		default:
+			cmd.Printf("downloaded %s from %s\n", res.Artifact, res.Source)
+		}
+	}
+
+	return ok
+}
+
+func addArtifactFlags(flags *pflag.FlagSet) {
+	flags.String("kubernetes", "", "version of Kubernetes components")
+	flags.String("etcd", "", "version of etcd")
+	flags.String("coredns", "", "version of CoreDNS")
+	flags.StringSlice("components", kubeComponents, "Kubernetes components")
+	flags.StringSlice("arch", []string{config.DefaultArch}, "architectures")
+}
+
+// artifactsFromFlags returns artifacts selected by flags added with addArtifactFlags
+func artifactsFromFlags(cmd *cobra.Command, cfg *config.Config) []fileproxy.Artifact {
+	flags := cmd.Flags()
+	kubeVersion := flagOrDefault(cmd, "kubernetes", cfg.ControlPlain.KubernetesVersion)
+	etcdVersion := flagOrDefault(cmd, "etcd", cfg.ControlPlain.EtcdVersion)
+	corednsVersion := flagOrDefault(cmd, "coredns", cfg.ControlPlain.CorednsVersion)
+	components, _ := flags.GetStringSlice("components")
+	arches, _ := flags.GetStringSlice("arch")
+
+	var artifacts []fileproxy.Artifact
+	for _, arch := range arches {
+		add := func(name, version string) {
+			a := fileproxy.NewArtifact(name, version)
+			a.Arch = arch
+			artifacts = append(artifacts, a)
+		}
+
+		for _, name := range components {
+			add(name, kubeVersion)
+		}
+		add("etcd", etcdVersion)
+		add("coredns", corednsVersion)
+	}
+
+	return artifacts
+}
+
+func flagOrDefault(cmd *cobra.Command, name, def string) string {
+	if v, _ := cmd.Flags().GetString(name); len(v) > 0 {
+		return v
+	}
+
+	return def
+}
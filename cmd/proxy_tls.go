@@ -0,0 +1,199 @@
+/*
+Copyright © 2024 Alexey Shulutkov <github@shulutkov.ru>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"slices"
+
+	"github.com/ks-tool/k8s-bootstrapper/internal/config"
+	"github.com/ks-tool/k8s-bootstrapper/pkg/pki"
+)
+
+var proxyCARequest = &pki.CertRequest{
+	Name:       config.DefaultProxyCAName,
+	CommonName: "file-proxy-ca",
+	PkiDir:     config.DefaultCertificatesDir,
+}
+
+// proxyServerCertRequest returns the request of the serving certificate, it's valid for the node,
+// the loopback and the host of the public URL
+func proxyServerCertRequest(cfg *config.Config) *pki.CertRequest {
+	altNames := pki.AltNames{
+		DNSNames: []string{cfg.NodeName, "localhost"},
+		IPs:      []net.IP{cfg.ControlPlain.LocalAPIEndpoint.AdvertiseAddress, net.IPv4(127, 0, 0, 1)},
+	}
+	if u, err := url.Parse(cfg.Proxy.PublicURL); err == nil {
+		host := u.Hostname()
+		if ip := net.ParseIP(host); ip != nil && !slices.ContainsFunc(altNames.IPs, ip.Equal) {
+			altNames.IPs = append(altNames.IPs, ip)
+		} else if ip == nil && len(host) > 0 && !slices.Contains(altNames.DNSNames, host) {
+			altNames.DNSNames = append(altNames.DNSNames, host)
+		}
+	}
+
+	return &pki.CertRequest{
+		Name:       "file-proxy",
+		CAName:     config.DefaultProxyCAName,
+		CommonName: "file-proxy",
+		Usages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		AltNames:   altNames,
+		PkiDir:     config.DefaultCertificatesDir,
+	}
+}
+
+func proxyClientCertRequest(cfg *config.Config) *pki.CertRequest {
+	return &pki.CertRequest{
+		Name:       "file-proxy-client",
+		CAName:     config.DefaultProxyCAName,
+		CommonName: cfg.NodeName,
+		Usages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		PkiDir:     config.DefaultCertificatesDir,
+	}
+}
+
+// proxyServerTLS returns the TLS config of the proxy, it's nil if TLS is disabled.
+// The serving certificate is issued from the proxy CA unless it's provided.
+func proxyServerTLS(cfg *config.Config) (*tls.Config, error) {
+	s := cfg.Proxy.TLS
+	if !s.Enabled {
+		return nil, nil
+	}
+
+	if s.ClientAuth && len(s.CAFile) == 0 {
+		if err := ensureProxyCA(); err != nil {
+			return nil, err
+		}
+	}
+
+	certFile, keyFile := s.CertFile, s.KeyFile
+	if len(certFile) == 0 || len(keyFile) == 0 {
+		// the CA key is only read to issue the certificate, so the proxy runs as a user without access to it
+		req := proxyServerCertRequest(cfg)
+		keyFile, certFile = req.KeyFilepath(), req.CertFilepath()
+		if !fileExists(keyFile) || !fileExists(certFile) {
+			if err := ensureProxyCA(); err != nil {
+				return nil, err
+			}
+			if _, err := req.Ensure(); err != nil {
+				return nil, fmt.Errorf("proxy tls: serving certificate: %v", err)
+			}
+		}
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("proxy tls: %v", err)
+	}
+
+	tlsCfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if s.ClientAuth {
+		if tlsCfg.ClientCAs, err = proxyCAPool(s); err != nil {
+			return nil, err
+		}
+		tlsCfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tlsCfg, nil
+}
+
+// proxyClientTLS returns the TLS config of nodes downloading from the proxy, it's nil if TLS is disabled.
+// The client certificate is issued from the proxy CA unless it's provided, it requires the proxy CA key on the node.
+func proxyClientTLS(cfg *config.Config) (*tls.Config, error) {
+	s := cfg.Proxy.TLS
+	if !s.Enabled {
+		return nil, nil
+	}
+
+	pool, err := proxyCAPool(s)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsCfg := &tls.Config{
+		RootCAs:    pool,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if !s.ClientAuth {
+		return tlsCfg, nil
+	}
+
+	certFile, keyFile := s.ClientCertFile, s.ClientKeyFile
+	if len(certFile) == 0 || len(keyFile) == 0 {
+		req := proxyClientCertRequest(cfg)
+		if _, err = req.Ensure(); err != nil {
+			return nil, fmt.Errorf("proxy tls: client certificate: %v", err)
+		}
+		keyFile, certFile = req.KeyFilepath(), req.CertFilepath()
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("proxy tls: %v", err)
+	}
+	tlsCfg.Certificates = []tls.Certificate{cert}
+
+	return tlsCfg, nil
+}
+
+// ensureProxyCA creates the proxy CA unless its certificate exists, the cluster CA is never used
+// as the proxy may run on a host which is not a control plane node
+func ensureProxyCA() error {
+	if fileExists(proxyCARequest.CAFilepath()) {
+		return nil
+	}
+
+	if _, err := proxyCARequest.Ensure(); err != nil {
+		return fmt.Errorf("proxy tls: proxy CA: %v", err)
+	}
+
+	return nil
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func proxyCAPool(s config.TLSSettings) (*x509.CertPool, error) {
+	caFile := s.CAFile
+	if len(caFile) == 0 {
+		caFile = proxyCARequest.CAFilepath()
+	}
+
+	b, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("proxy tls: %v", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("proxy tls: no certificates found in %q", caFile)
+	}
+
+	return pool, nil
+}
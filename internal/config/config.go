@@ -19,6 +19,9 @@ package config
 import (
 	"fmt"
 	"net"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 type Config struct {
@@ -35,6 +38,224 @@ type Config struct {
 
 	AssetsDir string `json:"assetsDir,omitempty"`
 	ProxyPort int    `json:"proxyPort,omitempty"`
+
+	// Proxy holds configuration for the file proxy cache.
+	Proxy ProxySettings `json:"proxy,omitempty"`
+}
+
+type ProxySettings struct {
+	// Listen are addresses the proxy listens on, e.g. 10.0.0.1:18080, [fd00::1]:18080, :18080
+	// or unix:/run/file-proxy/proxy.sock. Defaults to the advertise address and ProxyPort. The proxy service
+	// creates directories of sockets directly under /run, other directories must be writable by the proxy user.
+	Listen []string `json:"listen,omitempty"`
+	// PublicURL is the base URL nodes download artifacts from, e.g. of a load balancer or a NAT address
+	// in front of the proxy. Defaults to http://<advertise address>:<ProxyPort>, https if TLS is enabled.
+	PublicURL string `json:"publicURL,omitempty"`
+	// Endpoints defines additional artifacts served by the proxy, e.g. from Artifactory or Nexus raw repositories.
+	Endpoints []EndpointSettings `json:"endpoints,omitempty"`
+	// Upstreams is an ordered list of mirrors tried before the origin of an artifact,
+	// e.g. a site-local proxy, then a regional mirror.
+	Upstreams []UpstreamSettings `json:"upstreams,omitempty"`
+	// Cache defines eviction policies of the assets directory.
+	Cache CacheSettings `json:"cache,omitempty"`
+	// Signatures defines signature verification of artifacts per endpoint: "kubernetes" for Kubernetes
+	// binaries, "etcd", "coredns" or the name of an endpoint defined in Endpoints.
+	Signatures map[string]SignatureSettings `json:"signatures,omitempty"`
+	// TLS defines HTTPS of the proxy.
+	TLS TLSSettings `json:"tls,omitempty"`
+	// VersionTTL is how long latest versions and version lists of endpoints are cached, stale values
+	// are served while they're refreshed or if the endpoint is unreachable. Defaults to 10m.
+	VersionTTL metav1.Duration `json:"versionTTL,omitempty"`
+	// GitHub defines access to the GitHub API used by etcd and coredns endpoints and to list Kubernetes releases.
+	GitHub GitHubSettings `json:"github,omitempty"`
+	// Registry defines the pull-through cache of container images served under /v2/.
+	Registry RegistrySettings `json:"registry,omitempty"`
+	// Access restricts clients of the proxy.
+	Access AccessSettings `json:"access,omitempty"`
+	// Peers defines sharing of artifacts between nodes.
+	Peers PeerSettings `json:"peers,omitempty"`
+}
+
+// PeerSettings defines sharing of artifacts between nodes. Nodes announce themselves to the proxy, which lists them
+// under /_peers, download artifacts in chunks from peers having them and fall back to the proxy. Artifacts are verified
+// against sha256 checksums served by the proxy, so peers are not trusted.
+type PeerSettings struct {
+	// Enabled lets nodes serve their verified artifacts to each other and the proxy list them.
+	Enabled bool `json:"enabled,omitempty"`
+	// Port is the port nodes serve artifacts on at their advertise address. Defaults to 18081.
+	Port int `json:"port,omitempty"`
+	// TTL is how long the proxy lists a node after its last announcement, nodes announce themselves
+	// three times per TTL. Defaults to 1m.
+	TTL metav1.Duration `json:"ttl,omitempty"`
+	// Dir keeps artifacts verified by the node, they're shared with peers. Defaults to /var/lib/k8s-bootstrapper/peers.
+	Dir string `json:"dir,omitempty"`
+	// ChunkSize is the size in bytes of ranges downloaded from peers. Defaults to 8MiB.
+	ChunkSize int64 `json:"chunkSize,omitempty"`
+	// Concurrency is the number of chunks downloaded in parallel. Defaults to 4.
+	Concurrency int `json:"concurrency,omitempty"`
+}
+
+// AccessSettings restricts clients of the proxy and logs their requests. /healthz and /readyz are served to any client.
+type AccessSettings struct {
+	// AllowedCIDRs are networks of clients allowed to use the proxy, e.g. 10.0.0.0/8 or fd00::/8. Empty allows any client.
+	// Clients of unix sockets are local and not restricted by networks.
+	AllowedCIDRs []string `json:"allowedCIDRs,omitempty"`
+	// Tokens are bearer tokens accepted by the proxy. If tokens are defined here or TokenFile is set,
+	// requests must carry one of them in the Authorization header. Nodes present the first token.
+	Tokens []string `json:"tokens,omitempty"`
+	// TokenFile is a file with accepted bearer tokens, one per line. It's re-read when it's modified,
+	// so tokens are issued and revoked without restarting the proxy. Nodes present the first token
+	// of the file if Tokens is empty.
+	TokenFile string `json:"tokenFile,omitempty"`
+	// MaxRequestsPerClient limits concurrent requests of a client IP, requests above the limit
+	// are rejected with 429 Too Many Requests. Zero means unlimited.
+	MaxRequestsPerClient int `json:"maxRequestsPerClient,omitempty"`
+	// LogRequests logs every request with the client IP, the requested artifact, the status and the duration.
+	LogRequests bool `json:"logRequests,omitempty"`
+}
+
+// RegistrySettings defines the read-only OCI distribution pull-through cache. Manifests and blobs are stored
+// in the assets directory by their digests and verified against them. containerd uses the proxy as a mirror
+// configured in /etc/containerd/certs.d/<registry>/hosts.toml and passes the mirrored registry in the ns query parameter.
+type RegistrySettings struct {
+	// Enabled serves the OCI distribution API under /v2/.
+	Enabled bool `json:"enabled,omitempty"`
+	// Mirrors are registries served by the cache, requests without the ns query parameter are served by the first one.
+	// Defaults to the registry of ImageRepository.
+	Mirrors []RegistryMirror `json:"mirrors,omitempty"`
+	// TagTTL is how long a tag is resolved to the cached manifest before it's revalidated with the registry,
+	// the cached manifest is served if the registry is unreachable. Defaults to 10m.
+	TagTTL metav1.Duration `json:"tagTTL,omitempty"`
+	// Timeout limits connecting to registries and waiting for response headers. Defaults to 10s.
+	Timeout metav1.Duration `json:"timeout,omitempty"`
+	// MaxSize is the maximum total size of cached manifests and blobs, e.g. 50Gi. The least recently used
+	// are removed by the garbage collector of the cache and downloaded again when requested. Zero means unlimited.
+	MaxSize resource.Quantity `json:"maxSize,omitempty"`
+}
+
+// RegistryMirror is a registry mirrored by the cache.
+type RegistryMirror struct {
+	// Host is the name of the registry in image references, e.g. registry.k8s.io or docker.io.
+	Host string `json:"host"`
+	// URL is the URL of the registry. Defaults to https://<host>, https://registry-1.docker.io for docker.io.
+	URL string `json:"url,omitempty"`
+	// Username and PasswordFile are credentials of the registry, anonymous tokens are requested if they're empty.
+	Username     string `json:"username,omitempty"`
+	PasswordFile string `json:"passwordFile,omitempty"`
+}
+
+// GitHubSettings defines access to the GitHub API, unauthenticated requests are limited to 60 per hour.
+type GitHubSettings struct {
+	// BaseURL is the API URL of GitHub Enterprise, e.g. https://github.example.com/api/v3/. Defaults to https://api.github.com/.
+	BaseURL string `json:"baseURL,omitempty"`
+	// TokenEnv is the environment variable with the API token. Defaults to GITHUB_TOKEN.
+	TokenEnv string `json:"tokenEnv,omitempty"`
+	// TokenFile is a file with the API token, it's used if the environment variable is not set.
+	TokenFile string `json:"tokenFile,omitempty"`
+	// Timeout limits every request to the API. Defaults to 10s.
+	Timeout metav1.Duration `json:"timeout,omitempty"`
+	// MaxRateLimitWait is the longest time a request waits for the reset of the exceeded rate limit,
+	// the request fails if the limit is reset later. Defaults to 1m.
+	MaxRateLimitWait metav1.Duration `json:"maxRateLimitWait,omitempty"`
+}
+
+// TLSSettings defines HTTPS of the proxy and how nodes trust and authenticate to it. Certificates which
+// are not provided are issued from the proxy CA in the certificates directory, the CA is created if it's missing.
+type TLSSettings struct {
+	// Enabled serves the proxy over HTTPS, nodes download artifacts over HTTPS as well.
+	Enabled bool `json:"enabled,omitempty"`
+	// CertFile and KeyFile are the serving certificate and its private key in PEM format.
+	CertFile string `json:"certFile,omitempty"`
+	KeyFile  string `json:"keyFile,omitempty"`
+	// CAFile is the PEM bundle trusted by nodes to verify the proxy and by the proxy to verify clients.
+	// Defaults to the CA of the file proxy, /etc/kubernetes/pki/file-proxy-ca.crt.
+	CAFile string `json:"caFile,omitempty"`
+	// ClientAuth requires nodes to present a client certificate issued by the CA.
+	ClientAuth bool `json:"clientAuth,omitempty"`
+	// ClientCertFile and ClientKeyFile are the client certificate and its private key presented by nodes.
+	ClientCertFile string `json:"clientCertFile,omitempty"`
+	ClientKeyFile  string `json:"clientKeyFile,omitempty"`
+}
+
+// SignatureSettings defines how detached signatures of artifacts are verified by the proxy before caching
+// and by nodes before installing. Signatures are verified offline, the transparency log is not consulted.
+type SignatureSettings struct {
+	// Policy is one of "require", "warn" or "off". Defaults to "off".
+	Policy string `json:"policy,omitempty"`
+	// Type is "sigstore" for keyless signatures with a signing certificate or "gpg". Defaults to "sigstore".
+	Type string `json:"type,omitempty"`
+	// SignatureURL is the template of the signature or sigstore bundle URL. Defaults to the file URL with ".sig" suffix.
+	SignatureURL string `json:"signatureURL,omitempty"`
+	// CertificateURL is the template of the signing certificate URL. Defaults to the file URL with ".cert" suffix.
+	CertificateURL string `json:"certificateURL,omitempty"`
+	// TrustedRoot is a PEM file with root and intermediate certificates of the sigstore CA
+	// or a sigstore trusted_root.json file.
+	TrustedRoot string `json:"trustedRoot,omitempty"`
+	// Identities are accepted subject alternative names of the signing certificate,
+	// e.g. krel-trust@k8s-releng-prod.iam.gserviceaccount.com. Required for sigstore signatures.
+	Identities []string `json:"identities,omitempty"`
+	// Issuer is the expected OIDC issuer of the signing certificate, e.g. https://accounts.google.com.
+	// Required for sigstore signatures.
+	Issuer string `json:"issuer,omitempty"`
+	// AllowExpiredCertificates checks the sigstore certificate chain at the time the signing certificate
+	// was issued instead of now. It's required for Fulcio certificates which expire minutes after signing,
+	// but it's a weaker check: the signing time is not proven by the transparency log, so a signature
+	// made with a leaked key after the certificate expired is accepted.
+	AllowExpiredCertificates bool `json:"allowExpiredCertificates,omitempty"`
+	// KeyRing is a file with public keys trusted for gpg signatures.
+	KeyRing string `json:"keyRing,omitempty"`
+}
+
+// CacheSettings defines which artifacts are removed from the assets directory by the garbage collector.
+// Artifacts are evicted in least recently used order.
+type CacheSettings struct {
+	// MaxSize is the maximum total size of cached artifacts, e.g. 20Gi. Zero means unlimited.
+	MaxSize resource.Quantity `json:"maxSize,omitempty"`
+	// MaxVersions is the maximum number of cached versions of an artifact. Zero means unlimited.
+	MaxVersions int `json:"maxVersions,omitempty"`
+	// MaxAge removes artifacts which have not been accessed for the duration. Zero means unlimited.
+	MaxAge metav1.Duration `json:"maxAge,omitempty"`
+	// Pinned lists artifacts which are never evicted as <name>/<version> patterns, e.g. "*/v1.31.1" or "etcd/v3.5.*".
+	// Versions of the control plane components defined in this config are always pinned.
+	Pinned []string `json:"pinned,omitempty"`
+	// GCInterval is the interval of the garbage collection. Defaults to 1h.
+	GCInterval metav1.Duration `json:"gcInterval,omitempty"`
+}
+
+// UpstreamSettings describes a mirror with the same layout as the file proxy: /<name>/<version>
+// serves the artifact and /<name>/<version>.sha256 serves its checksum.
+type UpstreamSettings struct {
+	// URL is the base URL of the mirror, e.g. http://10.0.0.1:18080.
+	URL string `json:"url"`
+	// Timeout limits connecting to the mirror and waiting for its response headers. Defaults to 10s.
+	Timeout metav1.Duration `json:"timeout,omitempty"`
+	// Artifacts limits the mirror to the listed artifact names. Empty means all artifacts.
+	Artifacts []string `json:"artifacts,omitempty"`
+	// TokenFile is a file with the bearer token presented to the mirror if it restricts access.
+	TokenFile string `json:"tokenFile,omitempty"`
+}
+
+// EndpointSettings describes an artifact source with URLs built from Go templates.
+// Templates may refer to {{.Name}}, {{.Version}}, {{.OS}} and {{.Arch}} of the requested artifact.
+type EndpointSettings struct {
+	// Name is the name of the artifact, the proxy serves it under /<name>/<version>.
+	Name string `json:"name"`
+	// FileURL is the template of the artifact download URL.
+	FileURL string `json:"fileURL"`
+	// HashFileURL is the template of the sha256 checksum file URL.
+	HashFileURL string `json:"hashFileURL"`
+	// LastTag defines how the latest version of the artifact is resolved.
+	LastTag LastTagSettings `json:"lastTag,omitempty"`
+}
+
+// LastTagSettings defines the source of the latest version. Only one of Value or URL should be set.
+type LastTagSettings struct {
+	// Value is a fixed version.
+	Value string `json:"value,omitempty"`
+	// URL returns the latest version as plain text, or as JSON if JSONPath is set.
+	URL string `json:"url,omitempty"`
+	// JSONPath is a dot separated path to the version in the JSON document returned by URL, e.g. "data.0.version".
+	JSONPath string `json:"jsonPath,omitempty"`
 }
 
 type ControlPlainSettings struct {
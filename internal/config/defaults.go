@@ -21,8 +21,11 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 )
 
 const (
@@ -56,13 +59,43 @@ const (
 	DefaultKubeProxyDir = "/var/lib/kube-proxy"
 	// DefaultBinDir defines default location of binary files
 	DefaultBinDir = "/usr/local/bin"
+	// DefaultStateDir defines default location of the state of the bootstrapper, e.g. records of installed binaries
+	DefaultStateDir = "/var/lib/k8s-bootstrapper"
+	// DefaultBinaryName defines the name of the bootstrapper binary installed into DefaultBinDir
+	DefaultBinaryName = "k8s-bootstrapper"
+	// DefaultProxyServiceName defines the name of the systemd unit of the file proxy
+	DefaultProxyServiceName = "k8s-bootstrapper-proxy"
+	// DefaultProxyUsername defines the user the file proxy service runs as
+	DefaultProxyUsername = "file-proxy"
+	// DefaultProxyHomeDir defines the home directory of the file proxy user, "~" of AssetsDir is expanded to it
+	DefaultProxyHomeDir = "/var/lib/file-proxy"
 
 	DefaultCorednsVersion   = "v1.11.3"
 	DefaultAssetsServerPort = 18080
+	DefaultOS               = "linux"
+	DefaultArch             = "amd64"
+	DefaultUpstreamTimeout  = 10 * time.Second
+	DefaultCacheGCInterval  = time.Hour
+	DefaultVersionTTL       = 10 * time.Minute
+
+	DefaultDockerHubURL = "https://registry-1.docker.io"
+
+	DefaultGitHubTokenEnv         = "GITHUB_TOKEN"
+	DefaultGitHubTimeout          = 10 * time.Second
+	DefaultGitHubMaxRateLimitWait = time.Minute
+
+	DefaultPeerPort        = 18081
+	DefaultPeerTTL         = time.Minute
+	DefaultPeerDir         = DefaultStateDir + "/peers"
+	DefaultPeerChunkSize   = 8 << 20
+	DefaultPeerConcurrency = 4
 
 	DefaultUsername  = "kubernetes"
 	DefaultGroupname = "kubernetes"
 	DefaultCAName    = "ca"
+	// DefaultProxyCAName is the CA issuing certificates of the file proxy and its clients,
+	// it's separate from the cluster CA as the proxy runs before the cluster is initialized
+	DefaultProxyCAName = "file-proxy-ca"
 )
 
 const (
@@ -102,6 +135,105 @@ const (
 	NodesClusterRoleBinding = "system:node"
 )
 
+// SetGitHubDefaults sets defaults of the GitHub API access
+func SetGitHubDefaults(gh *GitHubSettings) {
+	if len(gh.TokenEnv) == 0 {
+		gh.TokenEnv = DefaultGitHubTokenEnv
+	}
+	if gh.Timeout.Duration == 0 {
+		gh.Timeout.Duration = DefaultGitHubTimeout
+	}
+	if gh.MaxRateLimitWait.Duration == 0 {
+		gh.MaxRateLimitWait.Duration = DefaultGitHubMaxRateLimitWait
+	}
+}
+
+func setRegistryDefaults(reg *RegistrySettings, imageRepository string) {
+	if len(reg.Mirrors) == 0 {
+		reg.Mirrors = []RegistryMirror{{Host: strings.SplitN(imageRepository, "/", 2)[0]}}
+	}
+	for i := range reg.Mirrors {
+		m := &reg.Mirrors[i]
+		if len(m.URL) > 0 {
+			continue
+		}
+		if m.Host == "docker.io" {
+			m.URL = DefaultDockerHubURL
+		} else {
+			m.URL = "https://" + m.Host
+		}
+	}
+	if reg.TagTTL.Duration == 0 {
+		reg.TagTTL.Duration = DefaultVersionTTL
+	}
+	if reg.Timeout.Duration == 0 {
+		reg.Timeout.Duration = DefaultUpstreamTimeout
+	}
+}
+
+func setPeerDefaults(peers *PeerSettings) {
+	if peers.Port == 0 {
+		peers.Port = DefaultPeerPort
+	}
+	if peers.TTL.Duration == 0 {
+		peers.TTL.Duration = DefaultPeerTTL
+	}
+	if len(peers.Dir) == 0 {
+		peers.Dir = DefaultPeerDir
+	}
+	if peers.ChunkSize == 0 {
+		peers.ChunkSize = DefaultPeerChunkSize
+	}
+	if peers.Concurrency == 0 {
+		peers.Concurrency = DefaultPeerConcurrency
+	}
+}
+
+// setProxyAddressDefaults sets the listen address and the public URL of the proxy to the advertise address
+// and validates the public URL
+func setProxyAddressDefaults(proxy *ProxySettings, advertiseAddress net.IP, port int) error {
+	addr := net.JoinHostPort(advertiseAddress.String(), strconv.Itoa(port))
+	if len(proxy.Listen) == 0 {
+		proxy.Listen = []string{addr}
+	}
+	if len(proxy.PublicURL) == 0 {
+		scheme := "http"
+		if proxy.TLS.Enabled {
+			scheme = "https"
+		}
+		proxy.PublicURL = scheme + "://" + addr
+	}
+
+	u, err := url.Parse(proxy.PublicURL)
+	if err != nil {
+		return fmt.Errorf("proxy.publicURL: %v", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 || len(u.RawQuery) > 0 || len(u.Fragment) > 0 {
+		return fmt.Errorf("proxy.publicURL %q: expected http(s)://host[:port][/path]", proxy.PublicURL)
+	}
+	proxy.PublicURL = strings.TrimSuffix(proxy.PublicURL, "/")
+
+	return nil
+}
+
+// validateSignatures checks that sigstore signatures pin the signer, any certificate issued
+// by the sigstore CA is valid otherwise
+func validateSignatures(sigs map[string]SignatureSettings) error {
+	for key, sig := range sigs {
+		if sig.Policy == "" || sig.Policy == "off" || (sig.Type != "" && sig.Type != "sigstore") {
+			continue
+		}
+		if len(sig.Identities) == 0 {
+			return fmt.Errorf("proxy.signatures.%s.identities: required for sigstore signatures", key)
+		}
+		if len(sig.Issuer) == 0 {
+			return fmt.Errorf("proxy.signatures.%s.issuer: required for sigstore signatures", key)
+		}
+	}
+
+	return nil
+}
+
 func SetDefaults(cfg *Config) error {
 	if len(cfg.ImageRepository) == 0 {
 		cfg.ImageRepository = DefaultImageRepository
@@ -142,6 +274,26 @@ func SetDefaults(cfg *Config) error {
 	if len(cfg.AssetsDir) == 0 {
 		cfg.AssetsDir = DefaultAssetsDir
 	}
+	if cfg.Proxy.Cache.GCInterval.Duration < 0 {
+		return fmt.Errorf("proxy.cache.gcInterval %s: must not be negative", cfg.Proxy.Cache.GCInterval.Duration)
+	}
+	if cfg.Proxy.Cache.GCInterval.Duration == 0 {
+		cfg.Proxy.Cache.GCInterval.Duration = DefaultCacheGCInterval
+	}
+	if cfg.Proxy.VersionTTL.Duration == 0 {
+		cfg.Proxy.VersionTTL.Duration = DefaultVersionTTL
+	}
+	SetGitHubDefaults(&cfg.Proxy.GitHub)
+	setRegistryDefaults(&cfg.Proxy.Registry, cfg.ImageRepository)
+	setPeerDefaults(&cfg.Proxy.Peers)
+	if err := validateSignatures(cfg.Proxy.Signatures); err != nil {
+		return err
+	}
+	for i := range cfg.Proxy.Upstreams {
+		if cfg.Proxy.Upstreams[i].Timeout.Duration == 0 {
+			cfg.Proxy.Upstreams[i].Timeout.Duration = DefaultUpstreamTimeout
+		}
+	}
 
 	if len(cfg.ControlPlain.LocalAPIEndpoint.AdvertiseAddress) == 0 {
 		hostIPs, err := net.LookupIP("ya.ru")
@@ -155,6 +307,9 @@ func SetDefaults(cfg *Config) error {
 		}
 		cfg.ControlPlain.LocalAPIEndpoint.AdvertiseAddress = conn.LocalAddr().(*net.UDPAddr).IP
 	}
+	if err := setProxyAddressDefaults(&cfg.Proxy, cfg.ControlPlain.LocalAPIEndpoint.AdvertiseAddress, cfg.ProxyPort); err != nil {
+		return err
+	}
 	if cfg.ControlPlain.LocalAPIEndpoint.BindPort < 1 {
 		cfg.ControlPlain.LocalAPIEndpoint.BindPort = DefaultKubeAPIServerPort
 	}
@@ -19,47 +19,182 @@ package download
 import (
 	"archive/tar"
 	"context"
+	"fmt"
+	"io"
+	"net/url"
 	"path"
 	"path/filepath"
+	"slices"
 
 	"github.com/ks-tool/k8s-bootstrapper/internal/config"
 	"github.com/ks-tool/k8s-bootstrapper/pkg/fetch"
+	"github.com/ks-tool/k8s-bootstrapper/pkg/file-proxy"
 	"github.com/ks-tool/k8s-bootstrapper/pkg/flow"
+	"github.com/ks-tool/k8s-bootstrapper/pkg/signature"
 )
 
 var (
-	Etcd = func(url string) flow.Action {
-		return download("etcd", url,
-			fetch.UnTar(config.DefaultBinDir, etcdFilter),
+	Etcd = func(src Source) flow.Action {
+		return download("etcd", src,
+			fetch.UnTar(config.DefaultBinDir, binFilter("etcd", "etcdctl")),
+			"etcd", "etcdctl",
 		)
 	}
-	KubeApiserver = func(url string) flow.Action {
+	KubeApiserver = func(src Source) flow.Action {
 		name := "kube-apiserver"
-		return download(name, url, toFile(name))
+		return download(name, src, toFile(name), name)
 	}
-	KubeControllerManager = func(url string) flow.Action {
+	KubeControllerManager = func(src Source) flow.Action {
 		name := "kube-controller-manager"
-		return download(name, url, toFile(name))
+		return download(name, src, toFile(name), name)
 	}
-	KubeScheduler = func(url string) flow.Action {
+	KubeScheduler = func(src Source) flow.Action {
 		name := "kube-scheduler"
-		return download(name, url, toFile(name))
+		return download(name, src, toFile(name), name)
 	}
-	Kubelet = func(url string) flow.Action {
+	Kubelet = func(src Source) flow.Action {
 		name := "kubelet"
-		return download(name, url, toFile(name))
+		return download(name, src, toFile(name), name)
 	}
-	Coredns = func(url string) flow.Action {
+	Coredns = func(src Source) flow.Action {
 		name := "coredns"
-		return download(name, url,
-			fetch.UnTar(config.DefaultBinDir),
+		return download(name, src,
+			fetch.UnTar(config.DefaultBinDir, binFilter(name)),
+			name,
 		)
 	}
 )
 
-func download(name, url string, writer fetch.Writer) flow.Action {
+// Source provides the content of an artifact and its checksum
+type Source interface {
+	// Checksum returns the sha256 checksum of the artifact.
+	Checksum(ctx context.Context) (string, error)
+	// Fetch passes the content of the artifact to the writer if it matches the checksum,
+	// the checksum is looked up by the source if it's empty.
+	Fetch(ctx context.Context, writer fetch.Writer, checksum string) error
+}
+
+type urlSource struct {
+	client *fetch.Client
+	url    string
+}
+
+// URL returns the source downloading the artifact over HTTP by the client, the artifact is verified
+// against the checksum served by the file proxy before it's passed to the writer
+func URL(client *fetch.Client, url string) Source {
+	return urlSource{client: client, url: url}
+}
+
+func (s urlSource) Checksum(ctx context.Context) (string, error) {
+	return s.client.Checksum(ctx, s.url)
+}
+
+func (s urlSource) Fetch(ctx context.Context, writer fetch.Writer, checksum string) error {
+	return s.client.WithChecksum(ctx, writer, s.url, checksum)
+}
+
+type signedSource struct {
+	urlSource
+	sigURL  string
+	certURL string
+	checker *signature.Checker
+}
+
+// SignedURL returns the source downloading the artifact over HTTP and verifying its signature
+// downloaded from sigURL and certURL, it's URL if the checker is nil
+func SignedURL(client *fetch.Client, url, sigURL, certURL string, c *signature.Checker) Source {
+	if !c.Enabled() {
+		return URL(client, url)
+	}
+
+	return signedSource{urlSource: urlSource{client: client, url: url}, sigURL: sigURL, certURL: certURL, checker: c}
+}
+
+func (s signedSource) Fetch(ctx context.Context, writer fetch.Writer, checksum string) error {
+	m, err := s.client.Signature(ctx, s.sigURL, s.certURL)
+	if err != nil {
+		if err = s.checker.Check(s.url, err); err != nil {
+			return err
+		}
+
+		return s.client.WithChecksum(ctx, writer, s.url, checksum)
+	}
+
+	return s.client.WithChecksum(ctx, fetch.Verified(writer, s.checker, s.url, m), s.url, checksum)
+}
+
+type bundleSource struct {
+	bundle   *fileproxy.Bundle
+	artifact fileproxy.Artifact
+	checker  *signature.Checker
+}
+
+// Bundle returns the source reading the artifact from the bundle, it's verified against
+// the checksum of the bundle manifest and the bundled signature if the checker is not nil
+func Bundle(b *fileproxy.Bundle, a fileproxy.Artifact, c *signature.Checker) Source {
+	return bundleSource{bundle: b, artifact: a, checker: c}
+}
+
+func (s bundleSource) Checksum(context.Context) (string, error) {
+	return s.bundle.Checksum(s.artifact)
+}
+
+func (s bundleSource) Fetch(_ context.Context, writer fetch.Writer, _ string) error {
+	if !s.checker.Enabled() {
+		return s.bundle.Extract(s.artifact, writer)
+	}
+
+	subject := s.artifact.String()
+	m, err := s.bundle.Signature(s.artifact)
+	if err != nil {
+		if err = s.checker.Check(subject, err); err != nil {
+			return err
+		}
+
+		return s.bundle.Extract(s.artifact, writer)
+	}
+
+	return s.bundle.ExtractVerified(s.artifact, s.checker, m, writer)
+}
+
+// download installs binaries of the artifact, the download is skipped if the artifact
+// has been installed and the binaries have not been modified since then.
+// Binaries replaced by a failed download, e.g. of an archive, are restored from their backups.
+func download(name string, src Source, writer fetch.Writer, binaries ...string) flow.Action {
 	action := func(ctx context.Context) (flow.StatusType, error) {
-		if err := fetch.WithContext(ctx, writer, url); err != nil {
+		log := ctx.Value(flow.LogKey).(*flow.Logger)
+		ctx = fetch.ContextWithProgress(ctx, func(p fetch.Progress) {
+			if p.Err != nil {
+				log.Warnf("download %s: %s", name, p)
+				return
+			}
+			if !isSidecar(p.URL) {
+				log.Progress(fmt.Sprintf("download %s: %s", name, p), p.Done)
+			}
+		})
+
+		checksum, err := src.Checksum(ctx)
+		if err != nil {
+			log.Debugf("checksum of %s is unknown: %v", name, err)
+		} else if isInstalled(name, checksum, binaries) {
+			log.Infof("%s is already installed", name)
+			return flow.StatusSkipped, nil
+		}
+
+		installed := statBinaries(binaries)
+		if err = src.Fetch(ctx, writer, checksum); err != nil {
+			restored, rerr := installed.rollback()
+			for _, filePath := range restored {
+				log.Infof("%s is restored from the backup", filePath)
+			}
+			if rerr != nil {
+				log.Warnf("rollback of %s failed: %v", name, rerr)
+			}
+
+			return flow.StatusFailed, err
+		}
+
+		if err = saveInstallation(name, checksum, binaries); err != nil {
 			return flow.StatusFailed, err
 		}
 
@@ -69,19 +204,37 @@ func download(name, url string, writer fetch.Writer) flow.Action {
 	return flow.NewAction(name, action)
 }
 
+// isSidecar reports whether the url is a checksum or a signature of an artifact, their progress is not rendered
+func isSidecar(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+
+	switch path.Ext(u.Path) {
+	case ".sha256", ".sig", ".cert":
+		return true
+	default:
+		return false
+	}
+}
+
 func toFile(name string) fetch.Writer {
-	return fetch.ToFile(filepath.Join(config.DefaultBinDir, name), 0755)
+	return fetch.Install(filepath.Join(config.DefaultBinDir, name), 0755)
 }
 
-func etcdFilter(dst string, tr *tar.Reader, hdr *tar.Header) error {
-	if hdr.Typeflag != tar.TypeReg {
-		return nil
-	}
+// binFilter installs the named binaries of the archive
+func binFilter(names ...string) fetch.TarFilter {
+	return func(dst string, r io.Reader, hdr *tar.Header) error {
+		if hdr.Typeflag != tar.TypeReg {
+			return nil
+		}
 
-	bn := path.Base(hdr.Name)
-	if bn == "etcd" || bn == "etcdctl" {
-		return fetch.ToFile(filepath.Join(dst, bn), 0755)(tr)
-	}
+		bn := path.Base(hdr.Name)
+		if slices.Contains(names, bn) {
+			return fetch.Install(filepath.Join(dst, bn), 0755)(r)
+		}
 
-	return nil
+		return nil
+	}
 }
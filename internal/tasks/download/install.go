@@ -0,0 +1,156 @@
+/*
+ Copyright (c) 2024 Alexey Shulutkov <github@shulutkov.ru>
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package download
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/ks-tool/k8s-bootstrapper/internal/config"
+	"github.com/ks-tool/k8s-bootstrapper/pkg/fetch"
+)
+
+// installation is the record of an installed artifact
+type installation struct {
+	// Checksum is the sha256 checksum of the artifact.
+	Checksum string `json:"checksum"`
+	// Binaries are sha256 checksums of the installed binaries by their names.
+	Binaries map[string]string `json:"binaries"`
+}
+
+func installationPath(name string) string {
+	return filepath.Join(config.DefaultStateDir, "installed", name+".json")
+}
+
+// isInstalled reports whether the artifact with the checksum has been installed
+// and its binaries are not modified or removed since then
+func isInstalled(name, checksum string, binaries []string) bool {
+	b, err := os.ReadFile(installationPath(name))
+	if err != nil {
+		return false
+	}
+
+	var inst installation
+	if err = json.Unmarshal(b, &inst); err != nil || inst.Checksum != checksum {
+		return false
+	}
+
+	for _, bin := range binaries {
+		sum, err := fileChecksum(filepath.Join(config.DefaultBinDir, bin))
+		if err != nil || sum != inst.Binaries[bin] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// saveInstallation records the installed artifact, the record is removed if the checksum
+// of the artifact is unknown, so the artifact is downloaded again next time
+func saveInstallation(name, checksum string, binaries []string) error {
+	filePath := installationPath(name)
+	if len(checksum) == 0 {
+		if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	inst := installation{Checksum: checksum, Binaries: make(map[string]string, len(binaries))}
+	for _, bin := range binaries {
+		sum, err := fileChecksum(filepath.Join(config.DefaultBinDir, bin))
+		if err != nil {
+			return err
+		}
+		inst.Binaries[bin] = sum
+	}
+
+	b, err := json.MarshalIndent(inst, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return err
+	}
+
+	tmp := filePath + ".tmp"
+	if err = os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, filePath)
+}
+
+func fileChecksum(filePath string) (string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = f.Close() }()
+
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// installedFiles are the binaries installed before a download, the binaries replaced
+// by a failed download are restored from their backups
+type installedFiles map[string]os.FileInfo
+
+func statBinaries(binaries []string) installedFiles {
+	files := make(installedFiles, len(binaries))
+	for _, bin := range binaries {
+		filePath := filepath.Join(config.DefaultBinDir, bin)
+		if fi, err := os.Lstat(filePath); err == nil {
+			files[filePath] = fi
+		}
+	}
+
+	return files
+}
+
+// rollback restores the binaries replaced since they were listed and returns their paths,
+// a binary is restored only if its backup is the file it replaced
+func (files installedFiles) rollback() ([]string, error) {
+	var restored []string
+	for filePath, before := range files {
+		cur, err := os.Lstat(filePath)
+		if err != nil || os.SameFile(before, cur) {
+			continue
+		}
+
+		bak, err := os.Lstat(filePath + fetch.BackupSuffix)
+		if err != nil || !os.SameFile(before, bak) {
+			continue
+		}
+
+		if err = fetch.Rollback(filePath); err != nil {
+			return restored, err
+		}
+		restored = append(restored, filePath)
+	}
+
+	return restored, nil
+}
@@ -96,33 +96,12 @@ func genCert(req *pki.CertRequest) flow.Action {
 		log := ctx.Value(flow.LogKey).(*flow.Logger)
 		log.Infof("generate private key and certificate %s", req.Name)
 
-		pk, err := req.PrivateKey()
+		created, err := req.Ensure()
 		if err != nil {
 			return flow.StatusFailed, err
 		}
-
-		if pk.IsNew() {
-			if err = pk.Save(""); err != nil {
-				return flow.StatusFailed, err
-			}
-		}
-
-		certFile := pk.CertificateFilepath()
-		if _, err = os.Stat(certFile); err == nil {
-			if !pk.IsNew() {
-				return flow.StatusSkipped, nil
-			}
-		} else if !os.IsNotExist(err) {
-			return flow.StatusFailed, err
-		}
-
-		crt, err := pk.CertificateSign(req)
-		if err != nil {
-			return flow.StatusFailed, fmt.Errorf("failed to sign certificate: %s", err)
-		}
-
-		if err = crt.Save(certFile); err != nil {
-			return flow.StatusFailed, err
+		if !created {
+			return flow.StatusSkipped, nil
 		}
 
 		return flow.StatusSuccess, nil
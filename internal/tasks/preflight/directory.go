@@ -49,6 +49,11 @@ var (
 			"mkdir assets",
 			Dir{Path: cfg.AssetsDir})
 	}
+	DirectoryProxyAssets = func(path string) flow.Action {
+		return actionDir(
+			"mkdir proxy assets",
+			Dir{Path: path, Perm: 0750, Owner: config.DefaultProxyUsername, Group: config.DefaultGroupname})
+	}
 )
 
 func actionDir(name string, d Dir) flow.Action { return flow.NewAction(name, d.MkdirAll) }
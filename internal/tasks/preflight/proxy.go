@@ -0,0 +1,37 @@
+/*
+Copyright © 2024 Alexey Shulutkov <github@shulutkov.ru>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package preflight
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ks-tool/k8s-bootstrapper/pkg/fetch"
+	"github.com/ks-tool/k8s-bootstrapper/pkg/flow"
+)
+
+// FileProxyReachable checks nodes reach the file proxy at the base URL downloads are built from
+// with the client downloading artifacts
+var FileProxyReachable = func(client *fetch.Client, url string) flow.Action {
+	return flow.NewAction("file proxy reachable", func(ctx context.Context) (flow.StatusType, error) {
+		if err := client.Get(ctx, fetch.Discard, url+"/healthz"); err != nil {
+			return flow.StatusFailed, fmt.Errorf("file proxy is unreachable at %s, check proxy.publicURL: %v", url, err)
+		}
+
+		return flow.StatusSuccess, nil
+	})
+}
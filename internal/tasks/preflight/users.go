@@ -52,6 +52,9 @@ var (
 	UserCoredns = actionUserGroup(
 		"useradd coredns",
 		User{Name: "coredns", Group: config.DefaultGroupname})
+	UserFileProxy = actionUserGroup(
+		"useradd "+config.DefaultProxyUsername,
+		User{Name: config.DefaultProxyUsername, Group: config.DefaultGroupname, HomeDir: config.DefaultProxyHomeDir, CreateHomeDir: true})
 )
 
 const (
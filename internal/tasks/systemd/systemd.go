@@ -22,6 +22,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 
 	"github.com/ks-tool/k8s-bootstrapper/internal/config"
 	"github.com/ks-tool/k8s-bootstrapper/pkg/flow"
@@ -114,60 +115,131 @@ var (
 		return flow.NewAction("daemon-reload", action)
 	}()
 	Enable = func(units ...string) flow.Action {
+		return systemctl("enable", units...)
+	}
+	Start = func(units ...string) flow.Action {
+		return systemctl("start", units...)
+	}
+	Restart = func(units ...string) flow.Action {
+		return systemctl("restart", units...)
+	}
+	Stop = func(units ...string) flow.Action {
+		return systemctl("stop", units...)
+	}
+	Disable = func(units ...string) flow.Action {
+		return systemctl("disable", units...)
+	}
+	Remove = func(units ...string) flow.Action {
 		action := func(ctx context.Context) (flow.StatusType, error) {
 			for _, unit := range units {
-				out, err := exec.Command("systemctl", "enable", unit).CombinedOutput()
-				if err != nil {
-					return flow.StatusFailed,
-						fmt.Errorf("failed to enable systemd unit %q: %s: %v", unit, out, err)
+				if err := systemd.RemoveUnit(unit); err != nil {
+					return flow.StatusFailed, fmt.Errorf("failed to remove systemd unit %q: %v", unit, err)
 				}
 			}
 
 			return flow.StatusSuccess, nil
 		}
 
-		return flow.NewAction("enable units", action)
+		return flow.NewAction("remove units", action)
 	}
-	Start = func(units ...string) flow.Action {
-		action := func(ctx context.Context) (flow.StatusType, error) {
-			for _, unit := range units {
-				out, err := exec.Command("systemctl", "start", unit).CombinedOutput()
-				if err != nil {
-					return flow.StatusFailed,
-						fmt.Errorf("failed to start systemd unit %q: %s: %v", unit, out, err)
-				}
-			}
+	// FileProxy runs the file proxy as the dedicated user which may only write the assets directory
+	// and directories of unix sockets it listens on, sockets directly under /run/<name>/ are put
+	// into the runtime directory created by systemd
+	FileProxy = func(configPath, assetsDir string, listen []string) flow.Action {
+		sysd := systemd.NewSystemdUnit()
+		sysd.Unit.Description = "k8s-bootstrapper file proxy"
+		sysd.Service.User = config.DefaultProxyUsername
+		sysd.Service.Group = config.DefaultGroupname
 
-			return flow.StatusSuccess, nil
+		args := map[string]string{}
+		if len(configPath) > 0 {
+			args["config"] = configPath
 		}
+		sysd.SetServiceExecStart(filepath.Join(config.DefaultBinDir, config.DefaultBinaryName)+" proxy", args)
+
+		svc := &sysd.Service
+		svc.NoNewPrivileges = true
+		svc.ProtectSystem = "strict"
+		svc.ProtectHome = "yes"
+		writable := []string{assetsDir}
+		var runtimeDirs []string
+		for _, addr := range listen {
+			sock, ok := strings.CutPrefix(addr, "unix:")
+			if !ok {
+				continue
+			}
 
-		return flow.NewAction("start units", action)
+			dir := filepath.Dir(filepath.Clean(sock))
+			if name, ok := strings.CutPrefix(dir, "/run/"); ok && !strings.Contains(name, "/") {
+				runtimeDirs = append(runtimeDirs, name)
+			} else {
+				writable = append(writable, dir)
+			}
+		}
+		svc.ReadWritePaths = strings.Join(writable, " ")
+		svc.RuntimeDirectory = strings.Join(runtimeDirs, " ")
+		svc.PrivateTmp = true
+		svc.PrivateDevices = true
+		svc.ProtectKernelTunables = true
+		svc.ProtectKernelModules = true
+		svc.ProtectControlGroups = true
+		svc.RestrictNamespaces = true
+		svc.RestrictRealtime = true
+		svc.LockPersonality = true
+		svc.MemoryDenyWriteExecute = true
+		svc.RestrictAddressFamilies = "AF_INET AF_INET6 AF_UNIX"
+		svc.SystemCallArchitectures = "native"
+
+		return flow.NewAction(config.DefaultProxyServiceName, func(ctx context.Context) (flow.StatusType, error) {
+			return writeUnit(config.DefaultProxyServiceName, sysd)
+		})
 	}
 )
 
-func gen(name string, args map[string]string) flow.Action {
-	path := filepath.Join(config.DefaultBinDir, name)
+func systemctl(verb string, units ...string) flow.Action {
 	action := func(ctx context.Context) (flow.StatusType, error) {
-		oldSysd, err := systemd.NewSystemdUnitFromUnitFile(name)
-		if err != nil && !os.IsNotExist(err) {
-			return flow.StatusFailed, err
+		for _, unit := range units {
+			out, err := exec.Command("systemctl", verb, unit).CombinedOutput()
+			if err != nil {
+				return flow.StatusFailed,
+					fmt.Errorf("failed to %s systemd unit %q: %s: %v", verb, unit, out, err)
+			}
 		}
 
+		return flow.StatusSuccess, nil
+	}
+
+	return flow.NewAction(verb+" units", action)
+}
+
+func gen(name string, args map[string]string) flow.Action {
+	path := filepath.Join(config.DefaultBinDir, name)
+	action := func(ctx context.Context) (flow.StatusType, error) {
 		sysd := systemd.NewSystemdUnit()
 		sysd.SetServiceExecStart(path, args)
 
-		if err == nil {
-			if sysd.String() == oldSysd.String() {
-				return flow.StatusSkipped, nil
-			}
-		}
+		return writeUnit(name, sysd)
+	}
+
+	return flow.NewAction(name, action)
+}
 
-		if err = sysd.WriteToUnit(name); err != nil {
-			return flow.StatusFailed, err
+// writeUnit writes the unit file unless it's up-to-date
+func writeUnit(name string, sysd *systemd.SystemdUnit) (flow.StatusType, error) {
+	oldSysd, err := systemd.NewSystemdUnitFromUnitFile(name)
+	if err != nil && !os.IsNotExist(err) {
+		return flow.StatusFailed, err
+	}
+
+	if err == nil {
+		if sysd.String() == oldSysd.String() {
+			return flow.StatusSkipped, nil
 		}
+	}
 
-		return flow.StatusSuccess, nil
+	if err = sysd.WriteToUnit(name); err != nil {
+		return flow.StatusFailed, err
 	}
 
-	return flow.NewAction(name, action)
+	return flow.StatusSuccess, nil
 }
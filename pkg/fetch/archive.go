@@ -0,0 +1,126 @@
+/*
+Copyright © 2024 Alexey Shulutkov <github@shulutkov.ru>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fetch
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// archive formats detected by magic bytes
+const (
+	formatTar = iota
+	formatGzip
+	formatXz
+	formatZstd
+	formatZip
+)
+
+var ErrUnknownFormat = errors.New("unknown archive format")
+
+var magics = []struct {
+	format int
+	offset int
+	magic  []byte
+}{
+	{format: formatGzip, magic: []byte{0x1f, 0x8b}},
+	{format: formatXz, magic: []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}},
+	{format: formatZstd, magic: []byte{0x28, 0xb5, 0x2f, 0xfd}},
+	{format: formatZip, magic: []byte{'P', 'K', 0x03, 0x04}},
+	// empty zip archive
+	{format: formatZip, magic: []byte{'P', 'K', 0x05, 0x06}},
+	{format: formatTar, offset: 257, magic: []byte("ustar")},
+}
+
+// UnTar unpacks files from an archive, see Extract
+func UnTar(dst string, filter ...TarFilter) Writer {
+	return Extract(dst, TarOptions{}, filter...)
+}
+
+// Extract unpacks files from a tar archive, plain or compressed by gzip, xz or zstd, or from a zip archive.
+// The format is detected by magic bytes. Names of entries are cleaned before they're passed to filters,
+// the archive is rejected if a name or a link target is absolute or points outside of dst.
+func Extract(dst string, opts TarOptions, filter ...TarFilter) Writer {
+	if filter == nil {
+		filter = []TarFilter{unTar}
+	}
+	opts = opts.withDefaults()
+
+	return func(r io.Reader) error {
+		br := bufio.NewReaderSize(r, 512)
+		format, err := detectFormat(br)
+		if err != nil {
+			return err
+		}
+
+		switch format {
+		case formatGzip:
+			gzr, err := gzip.NewReader(br)
+			if err != nil {
+				return err
+			}
+			defer func() { _ = gzr.Close() }()
+
+			return untar(gzr, dst, opts, filter)
+
+		case formatXz:
+			xzr, err := xz.NewReader(br)
+			if err != nil {
+				return err
+			}
+
+			return untar(xzr, dst, opts, filter)
+
+		case formatZstd:
+			zr, err := zstd.NewReader(br)
+			if err != nil {
+				return err
+			}
+			defer zr.Close()
+
+			return untar(zr, dst, opts, filter)
+
+		case formatZip:
+			return unzip(r, br, dst, opts, filter)
+
+		default:
+			return untar(br, dst, opts, filter)
+		}
+	}
+}
+
+func detectFormat(br *bufio.Reader) (int, error) {
+	// a short read means the archive is smaller than the peeked header
+	head, err := br.Peek(512)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return 0, err
+	}
+
+	for _, m := range magics {
+		if len(head) >= m.offset+len(m.magic) && bytes.Equal(head[m.offset:m.offset+len(m.magic)], m.magic) {
+			return m.format, nil
+		}
+	}
+
+	return 0, ErrUnknownFormat
+}
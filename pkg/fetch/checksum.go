@@ -0,0 +1,205 @@
+/*
+Copyright © 2024 Alexey Shulutkov <github@shulutkov.ru>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fetch
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+const (
+	hashFileSuffix = ".sha256"
+
+	// ArtifactSizeHeader is the header of checksum responses of the file proxy with the size of the artifact
+	ArtifactSizeHeader = "X-Artifact-Size"
+)
+
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// WithChecksum downloads url by DefaultClient and passes the content to dst only if it matches the checksum
+func WithChecksum(ctx context.Context, dst Writer, url, checksum string) error {
+	return DefaultClient.WithChecksum(ctx, dst, url, checksum)
+}
+
+// WithChecksum downloads url and passes the content to dst only if it matches the sha256 checksum.
+// If checksum is empty, it's taken from the ETag of the response or from the .sha256 file next to url
+// as the file proxy serves them. The content is spooled to a temporary file while it's downloaded,
+// so interrupted downloads are resumed and nothing is written by dst, e.g. files extracted
+// by UnTar filters, on mismatch. If the client has peers, the content is downloaded from them
+// first and url is the fallback, verified content is kept to be shared with peers.
+func (c *Client) WithChecksum(ctx context.Context, dst Writer, url, checksum string) error {
+	spool, err := os.CreateTemp("", "fetch-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = spool.Close()
+		_ = os.Remove(spool.Name())
+	}()
+
+	checksum = strings.ToLower(checksum)
+
+	fromPeers := false
+	if c.opts.Peers != nil {
+		if checksum, err = c.fromPeers(ctx, spool, url, checksum); err == nil {
+			fromPeers = true
+		} else if !errors.Is(err, errNoPeers) {
+			reportPeerError(ctx, url, err)
+		}
+	}
+
+	if !fromPeers {
+		if err = resetFile(spool); err != nil {
+			return err
+		}
+		if checksum, err = c.downloadVerified(ctx, spool, url, checksum); err != nil {
+			return err
+		}
+	}
+
+	if c.opts.Peers != nil {
+		if err = c.opts.Peers.keep(spool, checksum); err != nil {
+			reportPeerError(ctx, url, err)
+		}
+	}
+
+	if _, err = spool.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	return dst(spool)
+}
+
+// downloadVerified downloads url to the spool and returns the checksum the content matches
+func (c *Client) downloadVerified(ctx context.Context, spool *os.File, url, checksum string) (string, error) {
+	header, err := c.download(ctx, url, spool)
+	if err != nil {
+		return "", err
+	}
+
+	if len(checksum) == 0 {
+		checksum = etagChecksum(header.Get("ETag"))
+	}
+	if len(checksum) == 0 {
+		if checksum, err = c.Checksum(ctx, url); err != nil {
+			return "", err
+		}
+	}
+	checksum = strings.ToLower(checksum)
+
+	if err = verifyFile(spool, checksum); err != nil {
+		return "", fmt.Errorf("%s: %w", url, err)
+	}
+
+	return checksum, nil
+}
+
+// verifyFile returns ErrChecksumMismatch if the content of f does not match the sha256 checksum
+func verifyFile(f *os.File, checksum string) error {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	h := sha256.New()
+	buf := make([]byte, 5*1024*1024)
+	if _, err := io.CopyBuffer(h, f, buf); err != nil {
+		return err
+	}
+
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != checksum {
+		return fmt.Errorf("%w: expected %s, got %s", ErrChecksumMismatch, checksum, sum)
+	}
+
+	return nil
+}
+
+// resetFile truncates f and rewinds it
+func resetFile(f *os.File) error {
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+
+	_, err := f.Seek(0, io.SeekStart)
+	return err
+}
+
+// etagChecksum returns the sha256 checksum of a strong ETag or empty string
+func etagChecksum(etag string) string {
+	if strings.HasPrefix(etag, "W/") {
+		return ""
+	}
+
+	etag = strings.Trim(etag, `"`)
+	if !isChecksum(etag) {
+		return ""
+	}
+
+	return etag
+}
+
+// Checksum downloads the sha256 checksum of the file by DefaultClient
+func Checksum(ctx context.Context, fileURL string) (string, error) {
+	return DefaultClient.Checksum(ctx, fileURL)
+}
+
+// Checksum downloads the sha256 checksum of the file from <url>.sha256
+func (c *Client) Checksum(ctx context.Context, fileURL string) (string, error) {
+	checksum, _, err := c.checksum(ctx, fileURL)
+	return checksum, err
+}
+
+// checksum downloads the sha256 checksum of the file and returns it with the header of the response
+func (c *Client) checksum(ctx context.Context, fileURL string) (string, http.Header, error) {
+	u, err := url.Parse(fileURL)
+	if err != nil {
+		return "", nil, err
+	}
+	u.Path += hashFileSuffix
+
+	var b []byte
+	header, err := c.getHeader(ctx, ToBytes(&b), u.String())
+	if err != nil {
+		return "", nil, fmt.Errorf("fetch checksum: %w", err)
+	}
+
+	checksum := strings.TrimSpace(string(b))
+	if fields := strings.Fields(checksum); len(fields) > 0 {
+		checksum = fields[0]
+	}
+	if !isChecksum(checksum) {
+		return "", nil, fmt.Errorf("fetch checksum: invalid sha256 checksum %q", checksum)
+	}
+
+	return strings.ToLower(checksum), header, nil
+}
+
+func isChecksum(s string) bool {
+	if len(s) != sha256.Size*2 {
+		return false
+	}
+
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
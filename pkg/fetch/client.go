@@ -0,0 +1,390 @@
+/*
+Copyright © 2024 Alexey Shulutkov <github@shulutkov.ru>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fetch
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var errReadTimeout = errors.New("read timeout")
+
+// ClientOptions configures timeouts and retries of a client, zero values disable the limit
+type ClientOptions struct {
+	// ConnectTimeout limits dialing and the TLS handshake.
+	ConnectTimeout time.Duration
+	// ReadTimeout limits waiting for the response headers and for every read of the body.
+	ReadTimeout time.Duration
+	// Retries is the number of attempts after the first failed one.
+	Retries int
+	// Backoff is the delay before the first retry, it's doubled for every next retry up to MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// TLS configures trusted certificate authorities and client certificates, e.g. of the file proxy.
+	TLS *tls.Config
+	// Token is sent as the bearer token, e.g. to the file proxy restricting access.
+	Token string
+	// Peers lets WithChecksum download from other nodes before url, the token and TLS settings are not used with peers.
+	Peers *Peers
+}
+
+var DefaultClientOptions = ClientOptions{
+	ConnectTimeout: 10 * time.Second,
+	ReadTimeout:    30 * time.Second,
+	Retries:        5,
+	Backoff:        time.Second,
+	MaxBackoff:     30 * time.Second,
+}
+
+var DefaultClient = NewClient(DefaultClientOptions)
+
+// Client downloads files retrying failed requests, downloads spooled to a file
+// are resumed with range requests
+type Client struct {
+	http     *http.Client
+	peerHTTP *http.Client
+	opts     ClientOptions
+}
+
+func NewClient(opts ClientOptions) *Client {
+	dialer := &net.Dialer{Timeout: opts.ConnectTimeout}
+
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.DialContext = dialer.DialContext
+	tr.TLSHandshakeTimeout = opts.ConnectTimeout
+	tr.ResponseHeaderTimeout = opts.ReadTimeout
+
+	c := &Client{opts: opts}
+	if opts.Peers != nil {
+		c.peerHTTP = &http.Client{Transport: tr.Clone()}
+	}
+	if opts.TLS != nil {
+		tr.TLSClientConfig = opts.TLS
+	}
+	c.http = &http.Client{Transport: tr}
+
+	return c
+}
+
+// Get passes the response body to dst. Requests are retried until the response is received,
+// the download is not retried once dst has started reading.
+func (c *Client) Get(ctx context.Context, dst Writer, url string) error {
+	_, err := c.getHeader(ctx, dst, url)
+	return err
+}
+
+// getHeader is Get returning the header of the response
+func (c *Client) getHeader(ctx context.Context, dst Writer, url string) (http.Header, error) {
+	var (
+		resp *http.Response
+		err  error
+	)
+	for attempt := 0; ; attempt++ {
+		if resp, err = c.get(ctx, url, nil); err == nil {
+			break
+		}
+		if err = c.backoff(ctx, url, attempt, 0, err); err != nil {
+			return nil, err
+		}
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	body := c.idleTimeout(resp)
+	pr := newProgress(ctx, url, 0, resp.ContentLength)
+	if err = dst(io.TeeReader(body, pr)); err != nil {
+		return nil, body.err(err)
+	}
+	pr.done()
+
+	return resp.Header, nil
+}
+
+// download writes the content of url to f, interrupted transfers are resumed
+// with range requests. It returns the header of the first response.
+func (c *Client) download(ctx context.Context, url string, f *os.File) (http.Header, error) {
+	var (
+		header    http.Header
+		validator string
+		written   int64
+	)
+	for attempt := 0; ; attempt++ {
+		reqHeader := make(http.Header)
+		if written > 0 && len(validator) > 0 {
+			reqHeader.Set("Range", fmt.Sprintf("bytes=%d-", written))
+			reqHeader.Set("If-Range", validator)
+		}
+
+		err := func() error {
+			resp, err := c.get(ctx, url, reqHeader)
+			if err != nil {
+				return err
+			}
+			defer func() { _ = resp.Body.Close() }()
+
+			total := resp.ContentLength
+			if resp.StatusCode == http.StatusPartialContent {
+				start, size, err := parseContentRange(resp.Header.Get("Content-Range"))
+				if err != nil || start != written {
+					return &HttpError{status: resp.StatusCode, error: fmt.Errorf("unexpected content range %q", resp.Header.Get("Content-Range"))}
+				}
+				total = size
+			} else if written > 0 {
+				// the server does not support ranges or the file has changed
+				if err = f.Truncate(0); err != nil {
+					return writeError{err}
+				}
+				if _, err = f.Seek(0, io.SeekStart); err != nil {
+					return writeError{err}
+				}
+				written = 0
+			}
+
+			if header == nil {
+				header = resp.Header
+				validator = rangeValidator(resp.Header)
+			}
+
+			body := c.idleTimeout(resp)
+			pr := newProgress(ctx, url, written, total)
+			n, err := io.Copy(io.MultiWriter(writerFunc(func(p []byte) (int, error) {
+				n, err := f.Write(p)
+				if err != nil {
+					return n, writeError{err}
+				}
+				return n, nil
+			}), pr), body)
+			written += n
+			if err != nil {
+				return body.err(err)
+			}
+			pr.done()
+
+			return nil
+		}()
+		if err == nil {
+			return header, nil
+		}
+
+		if err = c.backoff(ctx, url, attempt, written, err); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (c *Client) get(ctx context.Context, url string, header http.Header) (*http.Response, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return nil, responseError(resp)
+	}
+
+	return resp, nil
+}
+
+func (c *Client) newRequest(ctx context.Context, method, url string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	if len(c.opts.Token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+c.opts.Token)
+	}
+
+	return req, nil
+}
+
+// responseError closes the body of the failed response and returns HttpError with its message
+func responseError(resp *http.Response) error {
+	defer func() { _ = resp.Body.Close() }()
+
+	msg := http.StatusText(resp.StatusCode)
+	if b, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<16)); len(b) > 0 {
+		msg = string(b)
+	}
+
+	return &HttpError{status: resp.StatusCode, error: errors.New(msg)}
+}
+
+// backoff waits before the next attempt, it returns err if the attempt should not be retried
+func (c *Client) backoff(ctx context.Context, url string, attempt int, written int64, err error) error {
+	if attempt >= c.opts.Retries || !retryable(ctx, err) {
+		return err
+	}
+
+	d := c.opts.Backoff << attempt
+	if c.opts.MaxBackoff > 0 && (d > c.opts.MaxBackoff || d <= 0) {
+		d = c.opts.MaxBackoff
+	}
+
+	if fn := progressFromContext(ctx); fn != nil {
+		fn(Progress{URL: url, Bytes: written, Total: -1, Err: err, Retry: attempt + 1})
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return err
+	case <-t.C:
+		return nil
+	}
+}
+
+func retryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+
+	var we writeError
+	if errors.As(err, &we) {
+		return false
+	}
+
+	var he *HttpError
+	if errors.As(err, &he) {
+		return he.status >= 500 || he.status == http.StatusTooManyRequests || he.status == http.StatusRequestTimeout
+	}
+
+	return true
+}
+
+// writeError is an error of the local file, such downloads are not retried
+type writeError struct {
+	error
+}
+
+func (e writeError) Unwrap() error {
+	return e.error
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
+
+// idleReader cancels the request if a read of the body takes longer than the timeout
+type idleReader struct {
+	r       io.Reader
+	timeout time.Duration
+	timer   *time.Timer
+	expired atomic.Bool
+}
+
+func (c *Client) idleTimeout(resp *http.Response) *idleReader {
+	ir := &idleReader{r: resp.Body, timeout: c.opts.ReadTimeout}
+	if ir.timeout > 0 {
+		body := resp.Body
+		ir.timer = time.AfterFunc(ir.timeout, func() {
+			ir.expired.Store(true)
+			_ = body.Close()
+		})
+		ir.timer.Stop()
+	}
+
+	return ir
+}
+
+func (r *idleReader) Read(p []byte) (int, error) {
+	if r.timer == nil {
+		return r.r.Read(p)
+	}
+
+	// time spent by the consumer between reads is not limited
+	r.timer.Reset(r.timeout)
+	n, err := r.r.Read(p)
+	r.timer.Stop()
+
+	return n, err
+}
+
+// err returns errReadTimeout if the body has been closed by the timer
+func (r *idleReader) err(err error) error {
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+
+	if r.expired.Load() {
+		return fmt.Errorf("%w: no data received for %s", errReadTimeout, r.timeout)
+	}
+
+	return err
+}
+
+// rangeValidator returns the strong ETag or Last-Modified to resume the download with If-Range
+func rangeValidator(h http.Header) string {
+	if etag := h.Get("ETag"); len(etag) > 0 && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+
+	return h.Get("Last-Modified")
+}
+
+// parseContentRange returns the first byte and the complete length of "bytes first-last/length",
+// the length is -1 if it's unknown
+func parseContentRange(s string) (int64, int64, error) {
+	s, ok := strings.CutPrefix(s, "bytes ")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid content range %q", s)
+	}
+
+	rng, length, ok := strings.Cut(s, "/")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid content range %q", s)
+	}
+
+	first, _, ok := strings.Cut(rng, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid content range %q", s)
+	}
+
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid content range %q", s)
+	}
+
+	size := int64(-1)
+	if length != "*" {
+		if size, err = strconv.ParseInt(length, 10, 64); err != nil {
+			return 0, 0, fmt.Errorf("invalid content range %q", s)
+		}
+	}
+
+	return start, size, nil
+}
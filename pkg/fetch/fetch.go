@@ -20,8 +20,9 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"io"
 	"net/http"
+
+	"github.com/ks-tool/k8s-bootstrapper/pkg/signature"
 )
 
 type HttpError struct {
@@ -41,25 +42,28 @@ func WithWriter(dst Writer, url string) error {
 	return WithContext(context.Background(), dst, url)
 }
 
+// WithContext passes the content of url downloaded by DefaultClient to dst
 func WithContext(ctx context.Context, dst Writer, url string) error {
-	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
-	if err != nil {
-		return err
-	}
+	return DefaultClient.Get(ctx, dst, url)
+}
 
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return err
-	}
+// Signature downloads the detached signature and the signing certificate by DefaultClient
+func Signature(ctx context.Context, sigURL, certURL string) (signature.Material, error) {
+	return DefaultClient.Signature(ctx, sigURL, certURL)
+}
 
-	if resp.StatusCode != http.StatusOK {
-		msg := http.StatusText(resp.StatusCode)
-		if b, _ := io.ReadAll(resp.Body); len(b) > 0 {
-			msg = string(b)
-		}
+// Signature downloads the detached signature and the signing certificate,
+// the certificate is optional as gpg signatures and sigstore bundles do not need it
+func (c *Client) Signature(ctx context.Context, sigURL, certURL string) (signature.Material, error) {
+	var m signature.Material
+	if err := c.Get(ctx, ToBytes(&m.Signature), sigURL); err != nil {
+		return m, fmt.Errorf("fetch signature: %w", err)
+	}
 
-		return &HttpError{status: resp.StatusCode, error: errors.New(msg)}
+	var e *HttpError
+	if err := c.Get(ctx, ToBytes(&m.Certificate), certURL); err != nil && (!errors.As(err, &e) || e.status != http.StatusNotFound) {
+		return m, fmt.Errorf("fetch certificate: %w", err)
 	}
 
-	return dst(resp.Body)
+	return m, nil
 }
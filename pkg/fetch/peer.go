@@ -0,0 +1,393 @@
+/*
+Copyright © 2024 Alexey Shulutkov <github@shulutkov.ru>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fetch
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// PeerBlobPath is the path of artifacts served by peers, artifacts are named by their sha256 checksums
+	PeerBlobPath = "/blobs/sha256/"
+
+	// maxPeerCandidates limits the number of peers asked whether they have an artifact
+	maxPeerCandidates = 8
+	peerProbeTimeout  = 5 * time.Second
+)
+
+var errNoPeers = errors.New("no peer has the artifact")
+
+// PeerOptions configures sharing of artifacts with other nodes
+type PeerOptions struct {
+	// DiscoveryURL lists peers and accepts announcements of this node, e.g. /_peers of the file proxy.
+	DiscoveryURL string
+	// URL is the base URL of this node serving Dir, it's excluded from peers.
+	URL string
+	// Dir keeps artifacts verified by WithChecksum by their sha256 checksums, they're served by Handler.
+	Dir string
+	// ChunkSize is the size of ranges downloaded from peers.
+	ChunkSize int64
+	// Concurrency is the number of ranges downloaded in parallel.
+	Concurrency int
+}
+
+// Peers shares artifacts with other nodes. Artifacts are downloaded from peers in chunks and verified
+// against checksums of the file proxy as a whole, so a peer serving wrong content only costs the fallback.
+type Peers struct {
+	opts PeerOptions
+}
+
+func NewPeers(opts PeerOptions) *Peers {
+	if opts.ChunkSize <= 0 {
+		opts.ChunkSize = 8 << 20
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = 1
+	}
+	opts.URL = strings.TrimSuffix(opts.URL, "/")
+
+	return &Peers{opts: opts}
+}
+
+// Handler serves kept artifacts to peers, range requests let peers download them in chunks
+func (p *Peers) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		checksum, ok := strings.CutPrefix(r.URL.Path, PeerBlobPath)
+		if !ok || !isChecksum(checksum) {
+			http.NotFound(w, r)
+			return
+		}
+
+		f, err := os.Open(p.blobPath(checksum))
+		if os.IsNotExist(err) {
+			http.NotFound(w, r)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer func() { _ = f.Close() }()
+
+		fi, err := f.Stat()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("ETag", `"`+checksum+`"`)
+		http.ServeContent(w, r, "", fi.ModTime(), f)
+	})
+}
+
+func (p *Peers) blobPath(checksum string) string {
+	return filepath.Join(p.opts.Dir, "sha256", checksum)
+}
+
+// keep copies the verified content of f to Dir unless it's kept already
+func (p *Peers) keep(f *os.File, checksum string) error {
+	if len(p.opts.Dir) == 0 {
+		return nil
+	}
+
+	dst := p.blobPath(checksum)
+	if _, err := os.Stat(dst); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	return writeFile(dst, 0644, f, false)
+}
+
+// Announce announces this node to DiscoveryURL by DefaultClient, see Client.Announce
+func Announce(ctx context.Context, interval time.Duration) {
+	DefaultClient.Announce(ctx, interval)
+}
+
+// Announce announces this node to the discovery URL of peers right away and every interval until ctx is done,
+// then the node is withdrawn. Failed announcements are reported to the progress function of ctx.
+func (c *Client) Announce(ctx context.Context, interval time.Duration) {
+	p := c.opts.Peers
+	if p == nil {
+		return
+	}
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		if err := c.peerRequest(ctx, http.MethodPut); err != nil && ctx.Err() == nil {
+			reportPeerError(ctx, p.opts.DiscoveryURL, fmt.Errorf("announce: %w", err))
+		}
+
+		select {
+		case <-ctx.Done():
+			ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), peerProbeTimeout)
+			defer cancel()
+
+			if err := c.peerRequest(ctx, http.MethodDelete); err != nil {
+				reportPeerError(ctx, p.opts.DiscoveryURL, fmt.Errorf("withdraw: %w", err))
+			}
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func (c *Client) peerRequest(ctx context.Context, method string) error {
+	p := c.opts.Peers
+	b, err := json.Marshal(struct {
+		URL string `json:"url"`
+	}{URL: p.opts.URL})
+	if err != nil {
+		return err
+	}
+
+	req, err := c.newRequest(ctx, method, p.opts.DiscoveryURL, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		return responseError(resp)
+	}
+
+	return resp.Body.Close()
+}
+
+// fromPeers downloads the artifact of url from peers having it to f and returns its checksum, the checksum
+// is looked up next to url if it's empty. Chunks are downloaded in parallel, a failed chunk is retried
+// from the other peers. It returns errNoPeers if no peer has the artifact.
+func (c *Client) fromPeers(ctx context.Context, f *os.File, url, checksum string) (string, error) {
+	expected, size, err := c.expectedBlob(ctx, url)
+	if err != nil {
+		return checksum, err
+	}
+	if len(checksum) == 0 {
+		checksum = expected
+	} else if checksum != expected {
+		return checksum, fmt.Errorf("checksum %s differs from the checksum of the file proxy %s", checksum, expected)
+	}
+
+	peers, err := c.peersHaving(ctx, checksum, size)
+	if err != nil {
+		return checksum, err
+	}
+
+	if err = resetFile(f); err != nil {
+		return checksum, err
+	}
+	if err = f.Truncate(size); err != nil {
+		return checksum, err
+	}
+
+	chunkSize := c.opts.Peers.opts.ChunkSize
+	chunks := make(chan int64)
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	var wg sync.WaitGroup
+	for i := 0; i < c.opts.Peers.opts.Concurrency && int64(i)*chunkSize < size; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for off := range chunks {
+				if err := c.peerChunk(ctx, peers, f, checksum, off, min(off+chunkSize, size)); err != nil {
+					cancel(err)
+				}
+			}
+		}()
+	}
+
+	for off := int64(0); off < size && ctx.Err() == nil; off += chunkSize {
+		select {
+		case chunks <- off:
+		case <-ctx.Done():
+		}
+	}
+	close(chunks)
+	wg.Wait()
+
+	if err = context.Cause(ctx); err != nil {
+		return checksum, err
+	}
+
+	return checksum, verifyFile(f, checksum)
+}
+
+// expectedBlob returns the checksum and the size of the artifact served by the file proxy,
+// peers are trusted neither with the size nor with the content
+func (c *Client) expectedBlob(ctx context.Context, url string) (string, int64, error) {
+	checksum, header, err := c.checksum(ctx, url)
+	if err != nil {
+		return "", 0, err
+	}
+
+	size, err := strconv.ParseInt(header.Get(ArtifactSizeHeader), 10, 64)
+	if err != nil || size <= 0 {
+		return "", 0, errors.New("the file proxy did not send the size of the artifact")
+	}
+
+	return checksum, size, nil
+}
+
+// peersHaving returns up to maxPeerCandidates peers having the artifact of the size in random order
+func (c *Client) peersHaving(ctx context.Context, checksum string, size int64) ([]string, error) {
+	var list struct {
+		Peers []struct {
+			URL string `json:"url"`
+		} `json:"peers"`
+	}
+	if err := c.Get(ctx, JSONUnmarshal(&list), c.opts.Peers.opts.DiscoveryURL); err != nil {
+		return nil, fmt.Errorf("discover peers: %w", err)
+	}
+
+	var urls []string
+	for _, peer := range list.Peers {
+		if u := strings.TrimSuffix(peer.URL, "/"); len(u) > 0 && u != c.opts.Peers.opts.URL {
+			urls = append(urls, u)
+		}
+	}
+	rand.Shuffle(len(urls), func(i, j int) { urls[i], urls[j] = urls[j], urls[i] })
+	if len(urls) > maxPeerCandidates {
+		urls = urls[:maxPeerCandidates]
+	}
+
+	sizes := make([]int64, len(urls))
+	var wg sync.WaitGroup
+	for i, u := range urls {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sizes[i] = c.peerBlobSize(ctx, u, checksum)
+		}()
+	}
+	wg.Wait()
+
+	// peers disagreeing with the file proxy about the size can't serve the same content
+	var peers []string
+	for i, u := range urls {
+		if sizes[i] == size {
+			peers = append(peers, u)
+		}
+	}
+	if len(peers) == 0 {
+		return nil, errNoPeers
+	}
+
+	return peers, nil
+}
+
+// peerBlobSize returns the size of the artifact served by the peer or -1 if the peer does not have it
+func (c *Client) peerBlobSize(ctx context.Context, peer, checksum string) int64 {
+	ctx, cancel := context.WithTimeout(ctx, peerProbeTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, peer+PeerBlobPath+checksum, nil)
+	if err != nil {
+		return -1
+	}
+
+	resp, err := c.peerHTTP.Do(req)
+	if err != nil {
+		return -1
+	}
+	_ = resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return -1
+	}
+
+	return resp.ContentLength
+}
+
+// peerChunk downloads bytes [off, end) of the artifact to f, the peers are tried
+// starting from the one picked by the offset, so chunks are spread over peers
+func (c *Client) peerChunk(ctx context.Context, peers []string, f *os.File, checksum string, off, end int64) error {
+	first := int(off/c.opts.Peers.opts.ChunkSize) % len(peers)
+
+	var err error
+	for i := range peers {
+		peer := peers[(first+i)%len(peers)]
+		if err = c.peerRange(ctx, peer, f, checksum, off, end); err == nil || ctx.Err() != nil {
+			return err
+		}
+	}
+
+	return fmt.Errorf("chunk %d-%d: %w", off, end-1, err)
+}
+
+func (c *Client) peerRange(ctx context.Context, peer string, f *os.File, checksum string, off, end int64) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, peer+PeerBlobPath+checksum, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, end-1))
+
+	resp, err := c.peerHTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("%s: %w", peer, responseError(resp))
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if start, _, err := parseContentRange(resp.Header.Get("Content-Range")); err != nil || start != off || resp.ContentLength != end-off {
+		return fmt.Errorf("%s: unexpected content range %q", peer, resp.Header.Get("Content-Range"))
+	}
+
+	body := c.idleTimeout(resp)
+	if _, err = io.CopyN(io.NewOffsetWriter(f, off), body, end-off); err != nil {
+		return fmt.Errorf("%s: %w", peer, body.err(err))
+	}
+
+	return nil
+}
+
+func reportPeerError(ctx context.Context, url string, err error) {
+	if fn := progressFromContext(ctx); fn != nil {
+		fn(Progress{URL: url, Total: -1, Err: fmt.Errorf("peers: %w", err)})
+	}
+}
@@ -0,0 +1,124 @@
+/*
+Copyright © 2024 Alexey Shulutkov <github@shulutkov.ru>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fetch
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/ks-tool/k8s-bootstrapper/utils"
+)
+
+const progressInterval = time.Second
+
+type progressKey struct{}
+
+// Progress is the state of a download
+type Progress struct {
+	URL string
+	// Bytes is the number of received bytes including bytes of resumed attempts.
+	Bytes int64
+	// Total is the size of the file, it's -1 if it's unknown.
+	Total int64
+	// Rate is the download speed of the current attempt in bytes per second.
+	Rate float64
+	// Done is set when the download is complete.
+	Done bool
+	// Err is the error of the failed attempt, it's set with the number of the Retry that follows.
+	// Retry is zero if the download falls back to another source, e.g. from peers to the file proxy.
+	Err   error
+	Retry int
+}
+
+func (p Progress) String() string {
+	if p.Err != nil && p.Retry > 0 {
+		return fmt.Sprintf("%v, retry %d", p.Err, p.Retry)
+	} else if p.Err != nil {
+		return p.Err.Error()
+	}
+
+	s := utils.FormatSize(p.Bytes)
+	if p.Total >= 0 {
+		s += " of " + utils.FormatSize(p.Total)
+	}
+
+	return fmt.Sprintf("%s (%s/s)", s, utils.FormatSize(int64(p.Rate)))
+}
+
+type ProgressFunc func(Progress)
+
+// ContextWithProgress returns the context reporting progress of downloads to fn at most once a second
+func ContextWithProgress(ctx context.Context, fn ProgressFunc) context.Context {
+	return context.WithValue(ctx, progressKey{}, fn)
+}
+
+func progressFromContext(ctx context.Context) ProgressFunc {
+	fn, _ := ctx.Value(progressKey{}).(ProgressFunc)
+	return fn
+}
+
+// progress counts bytes written to it and reports them
+type progress struct {
+	fn    ProgressFunc
+	p     Progress
+	base  int64
+	start time.Time
+	last  time.Time
+}
+
+func newProgress(ctx context.Context, url string, base, total int64) *progress {
+	now := time.Now()
+	if total >= 0 && base > 0 && total < base {
+		total = -1
+	}
+
+	return &progress{
+		fn:    progressFromContext(ctx),
+		p:     Progress{URL: url, Bytes: base, Total: total},
+		base:  base,
+		start: now,
+		last:  now,
+	}
+}
+
+func (p *progress) Write(b []byte) (int, error) {
+	p.p.Bytes += int64(len(b))
+	if p.fn != nil {
+		if now := time.Now(); now.Sub(p.last) >= progressInterval {
+			p.last = now
+			p.report(now)
+		}
+	}
+
+	return len(b), nil
+}
+
+func (p *progress) done() {
+	if p.fn != nil {
+		p.p.Done = true
+		p.report(time.Now())
+	}
+}
+
+func (p *progress) report(now time.Time) {
+	if elapsed := now.Sub(p.start).Seconds(); elapsed > 0 {
+		p.p.Rate = float64(p.p.Bytes-p.base) / elapsed
+	}
+
+	p.fn(p.p)
+}
@@ -0,0 +1,281 @@
+/*
+Copyright © 2024 Alexey Shulutkov <github@shulutkov.ru>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fetch
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/ks-tool/k8s-bootstrapper/utils"
+)
+
+// DefaultMaxExtractSize is the default limit of the total size of files extracted from an archive
+const DefaultMaxExtractSize = 4 << 30
+
+var ErrUnsafePath = errors.New("unsafe path")
+
+// TarFilter extracts the entry of an archive read from r, entries of zip archives are described by tar headers
+type TarFilter func(dst string, r io.Reader, hdr *tar.Header) error
+
+// TarOptions selects entries of an archive passed to filters of Extract
+type TarOptions struct {
+	// StripComponents is the number of leading elements removed from names of entries,
+	// entries with fewer elements are skipped.
+	StripComponents int
+	// Include is the list of path.Match patterns of names, after leading elements are stripped,
+	// of entries to extract. An entry is also extracted if a pattern matches one of its parent directories.
+	// All entries are extracted if the list is empty.
+	Include []string
+	// MaxSize limits the total size of regular files of the archive, it's DefaultMaxExtractSize if zero.
+	MaxSize int64
+}
+
+func (o TarOptions) withDefaults() TarOptions {
+	if o.MaxSize == 0 {
+		o.MaxSize = DefaultMaxExtractSize
+	}
+
+	return o
+}
+
+// untar passes entries of the tar stream to filters
+func untar(r io.Reader, dst string, opts TarOptions, filter []TarFilter) error {
+	var size int64
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if hdr == nil {
+			continue
+		}
+
+		ok, err := opts.apply(hdr)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+
+		if hdr.Typeflag == tar.TypeReg {
+			if size, err = opts.addSize(size, hdr.Size); err != nil {
+				return err
+			}
+		}
+
+		for _, f := range filter {
+			if err = f(dst, tr, hdr); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// addSize returns the total size of extracted files, it fails if the size exceeds the limit
+func (o TarOptions) addSize(total, size int64) (int64, error) {
+	if total += size; size < 0 || total > o.MaxSize {
+		return total, fmt.Errorf("archive exceeds the size limit of %s", utils.FormatSize(o.MaxSize))
+	}
+
+	return total, nil
+}
+
+// apply cleans and strips the name and the hard link target of the entry,
+// it returns false if the entry is not extracted
+func (o TarOptions) apply(hdr *tar.Header) (bool, error) {
+	name, err := o.name(hdr.Name)
+	if err != nil || len(name) == 0 {
+		return false, err
+	}
+
+	if len(o.Include) > 0 && !o.included(name) {
+		return false, nil
+	}
+
+	if hdr.Typeflag == tar.TypeLink {
+		link, err := o.name(hdr.Linkname)
+		if err != nil {
+			return false, err
+		}
+		if len(link) == 0 {
+			return false, fmt.Errorf("%q: %w: hard link target %q is stripped", name, ErrUnsafePath, hdr.Linkname)
+		}
+		hdr.Linkname = link
+	}
+
+	hdr.Name = name
+	return true, nil
+}
+
+// name returns the cleaned name without stripped elements, it's empty if the entry is skipped
+func (o TarOptions) name(name string) (string, error) {
+	clean, err := cleanName(name)
+	if err != nil {
+		return "", err
+	}
+
+	parts := strings.Split(clean, "/")
+	if clean == "." || len(parts) <= o.StripComponents {
+		return "", nil
+	}
+
+	return path.Join(parts[o.StripComponents:]...), nil
+}
+
+func (o TarOptions) included(name string) bool {
+	for n := name; n != "." && n != "/"; n = path.Dir(n) {
+		if slices.ContainsFunc(o.Include, func(pattern string) bool {
+			ok, _ := path.Match(pattern, n)
+			return ok
+		}) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// cleanName rejects absolute names and names pointing outside of the archive
+func cleanName(name string) (string, error) {
+	if path.IsAbs(name) || strings.Contains(name, `\`) {
+		return "", fmt.Errorf("%q: %w", name, ErrUnsafePath)
+	}
+
+	clean := path.Clean(name)
+	if clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("%q: %w", name, ErrUnsafePath)
+	}
+
+	return clean, nil
+}
+
+// unTar extracts directories, regular files and links,
+// other entries, e.g. devices, are skipped
+func unTar(dst string, r io.Reader, hdr *tar.Header) error {
+	target, err := entryPath(dst, hdr.Name)
+	if err != nil {
+		return err
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if fi, err := os.Lstat(target); err == nil && !fi.IsDir() {
+			return fmt.Errorf("%q: %w: not a directory", hdr.Name, ErrUnsafePath)
+		}
+		return os.MkdirAll(target, 0755)
+
+	case tar.TypeReg:
+		if err = os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		return ToFile(target, os.FileMode(hdr.Mode).Perm())(r)
+
+	case tar.TypeSymlink:
+		if path.IsAbs(hdr.Linkname) || !leadingDotDot(hdr.Linkname) {
+			return fmt.Errorf("%q: %w: symlink target %q", hdr.Name, ErrUnsafePath, hdr.Linkname)
+		}
+		if _, err = cleanName(path.Join(path.Dir(hdr.Name), hdr.Linkname)); err != nil {
+			return fmt.Errorf("%q: %w: symlink target %q", hdr.Name, ErrUnsafePath, hdr.Linkname)
+		}
+		if err = os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		if err = os.Remove(target); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return os.Symlink(hdr.Linkname, target)
+
+	case tar.TypeLink:
+		source, err := entryPath(dst, hdr.Linkname)
+		if err != nil {
+			return err
+		}
+		if fi, err := os.Lstat(source); err != nil {
+			return err
+		} else if !fi.Mode().IsRegular() {
+			return fmt.Errorf("%q: %w: hard link target %q is not a regular file", hdr.Name, ErrUnsafePath, hdr.Linkname)
+		}
+		if err = os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		if err = os.Remove(target); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return os.Link(source, target)
+	}
+
+	return nil
+}
+
+// leadingDotDot reports whether ".." elements of the link target are leading ones only,
+// they resolve through real directories as parents of entries are never symlinks,
+// while ".." following another element may resolve through a symlink outside of dst
+func leadingDotDot(link string) bool {
+	leading := true
+	for _, elem := range strings.Split(link, "/") {
+		switch elem {
+		case "", ".":
+		case "..":
+			if !leading {
+				return false
+			}
+		default:
+			leading = false
+		}
+	}
+
+	return true
+}
+
+// entryPath returns the path of the entry in dst, it fails if a parent directory
+// of the entry is a symlink, so nothing is written outside of dst through links
+func entryPath(dst, name string) (string, error) {
+	dir := dst
+	for _, elem := range strings.Split(path.Dir(name), "/") {
+		if elem == "." {
+			continue
+		}
+
+		dir = filepath.Join(dir, elem)
+		fi, err := os.Lstat(dir)
+		if os.IsNotExist(err) {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		if !fi.IsDir() {
+			return "", fmt.Errorf("%q: %w: %q is not a directory", name, ErrUnsafePath, dir)
+		}
+	}
+
+	return filepath.Join(dst, filepath.FromSlash(name)), nil
+}
@@ -0,0 +1,277 @@
+/*
+Copyright © 2024 Alexey Shulutkov <github@shulutkov.ru>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fetch
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type tarEntry struct {
+	hdr  tar.Header
+	body string
+}
+
+func file(name, body string) tarEntry {
+	return tarEntry{hdr: tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0644, Size: int64(len(body))}, body: body}
+}
+
+func dir(name string) tarEntry {
+	return tarEntry{hdr: tar.Header{Typeflag: tar.TypeDir, Name: name, Mode: 0755}}
+}
+
+func symlink(name, target string) tarEntry {
+	return tarEntry{hdr: tar.Header{Typeflag: tar.TypeSymlink, Name: name, Linkname: target}}
+}
+
+func hardlink(name, target string) tarEntry {
+	return tarEntry{hdr: tar.Header{Typeflag: tar.TypeLink, Name: name, Linkname: target}}
+}
+
+func buildTar(t *testing.T, entries ...tarEntry) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := e.hdr
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+// extract unpacks the archive into dst/root, so dst/outside is outside of the destination
+func extract(t *testing.T, opts TarOptions, entries ...tarEntry) (string, error) {
+	t.Helper()
+
+	root := filepath.Join(t.TempDir(), "root")
+	if err := os.Mkdir(root, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	return root, Extract(root, opts)(bytes.NewReader(buildTar(t, entries...)))
+}
+
+func TestCleanName(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		want string
+		err  bool
+	}{
+		{name: "a/b", want: "a/b"},
+		{name: "./a//b/", want: "a/b"},
+		{name: "a/../b", want: "b"},
+		{name: "./", want: "."},
+		{name: "../x", err: true},
+		{name: "a/../../x", err: true},
+		{name: "..", err: true},
+		{name: "/abs", err: true},
+		{name: `a\..\b`, err: true},
+		{name: `..\x`, err: true},
+	} {
+		got, err := cleanName(tc.name)
+		if tc.err {
+			if !errors.Is(err, ErrUnsafePath) {
+				t.Errorf("cleanName(%q) error = %v, want ErrUnsafePath", tc.name, err)
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Errorf("cleanName(%q) = %q, %v, want %q", tc.name, got, err, tc.want)
+		}
+	}
+}
+
+func TestTarOptionsApply(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		opts  TarOptions
+		entry string
+		want  string
+		ok    bool
+	}{
+		{name: "plain", entry: "etcd/etcd", want: "etcd/etcd", ok: true},
+		{name: "strip", opts: TarOptions{StripComponents: 1}, entry: "etcd-v3/etcd", want: "etcd", ok: true},
+		{name: "stripped to empty", opts: TarOptions{StripComponents: 1}, entry: "etcd-v3/", ok: false},
+		{name: "fewer elements", opts: TarOptions{StripComponents: 2}, entry: "etcd-v3/etcd", ok: false},
+		{name: "current directory", entry: "./", ok: false},
+		{name: "included", opts: TarOptions{Include: []string{"etcd*"}}, entry: "etcdctl", want: "etcdctl", ok: true},
+		{name: "included parent", opts: TarOptions{Include: []string{"docs"}}, entry: "docs/a/b", want: "docs/a/b", ok: true},
+		{name: "excluded", opts: TarOptions{Include: []string{"etcd*"}}, entry: "README.md", ok: false},
+		{name: "included after strip", opts: TarOptions{StripComponents: 1, Include: []string{"etcd"}}, entry: "etcd-v3/etcd", want: "etcd", ok: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			hdr := &tar.Header{Typeflag: tar.TypeReg, Name: tc.entry}
+			ok, err := tc.opts.apply(hdr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != tc.ok || (ok && hdr.Name != tc.want) {
+				t.Errorf("apply(%q) = %q, %v, want %q, %v", tc.entry, hdr.Name, ok, tc.want, tc.ok)
+			}
+		})
+	}
+}
+
+func TestTarOptionsAddSize(t *testing.T) {
+	opts := TarOptions{MaxSize: 10}
+	total, err := opts.addSize(0, 6)
+	if err != nil || total != 6 {
+		t.Fatalf("addSize(0, 6) = %d, %v", total, err)
+	}
+	if _, err = opts.addSize(total, 5); err == nil {
+		t.Error("addSize above the limit succeeded")
+	}
+	if _, err = opts.addSize(0, -1); err == nil {
+		t.Error("addSize of a negative size succeeded")
+	}
+}
+
+func TestExtractUnsafeNames(t *testing.T) {
+	for _, name := range []string{"../x", "/abs", `a\..\b`, "a/../../x"} {
+		t.Run(name, func(t *testing.T) {
+			root, err := extract(t, TarOptions{}, file(name, "x"))
+			if !errors.Is(err, ErrUnsafePath) {
+				t.Fatalf("error = %v, want ErrUnsafePath", err)
+			}
+			if _, err = os.Stat(filepath.Join(filepath.Dir(root), "x")); !os.IsNotExist(err) {
+				t.Errorf("file written outside of dst: %v", err)
+			}
+		})
+	}
+}
+
+func TestExtractSymlinkEscape(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		entries []tarEntry
+	}{
+		{name: "relative", entries: []tarEntry{symlink("link", "../outside"), file("link/x", "x")}},
+		{name: "absolute", entries: []tarEntry{symlink("link", "/tmp"), file("link/x", "x")}},
+		{name: "through a directory", entries: []tarEntry{dir("a"), symlink("a/link", "../../outside"), file("a/link/x", "x")}},
+		{name: "dotdot after an element", entries: []tarEntry{symlink("self", "."), symlink("link", "self/../../outside"), file("link/x", "x")}},
+		{name: "write through a link inside dst", entries: []tarEntry{dir("d"), symlink("link", "d"), file("link/x", "x")}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			root, err := extract(t, TarOptions{}, tc.entries...)
+			if !errors.Is(err, ErrUnsafePath) {
+				t.Fatalf("error = %v, want ErrUnsafePath", err)
+			}
+			if _, err = os.Stat(filepath.Join(filepath.Dir(root), "outside", "x")); !os.IsNotExist(err) {
+				t.Errorf("file written outside of dst: %v", err)
+			}
+		})
+	}
+}
+
+func TestExtractExistingSymlink(t *testing.T) {
+	base := t.TempDir()
+	root, outside := filepath.Join(base, "root"), filepath.Join(base, "outside")
+	for _, d := range []string{root, outside} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	err := Extract(root, TarOptions{})(bytes.NewReader(buildTar(t, file("link/x", "x"))))
+	if !errors.Is(err, ErrUnsafePath) {
+		t.Fatalf("error = %v, want ErrUnsafePath", err)
+	}
+	if _, err = os.Stat(filepath.Join(outside, "x")); !os.IsNotExist(err) {
+		t.Errorf("file written outside of dst: %v", err)
+	}
+}
+
+func TestExtractHardlink(t *testing.T) {
+	for _, target := range []string{"../outside", "/etc/passwd", "a/../../outside"} {
+		t.Run(target, func(t *testing.T) {
+			_, err := extract(t, TarOptions{}, hardlink("link", target))
+			if !errors.Is(err, ErrUnsafePath) {
+				t.Fatalf("error = %v, want ErrUnsafePath", err)
+			}
+		})
+	}
+
+	t.Run("stripped target", func(t *testing.T) {
+		_, err := extract(t, TarOptions{StripComponents: 1}, file("top", "x"), hardlink("d/link", "top"))
+		if !errors.Is(err, ErrUnsafePath) {
+			t.Fatalf("error = %v, want ErrUnsafePath", err)
+		}
+	})
+
+	t.Run("inside", func(t *testing.T) {
+		root, err := extract(t, TarOptions{}, file("a", "x"), hardlink("b", "a"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b, err := os.ReadFile(filepath.Join(root, "b")); err != nil || string(b) != "x" {
+			t.Errorf("b = %q, %v", b, err)
+		}
+	})
+}
+
+func TestExtractMaxSize(t *testing.T) {
+	_, err := extract(t, TarOptions{MaxSize: 15}, file("a", "0123456789"), file("b", "0123456789"))
+	if err == nil {
+		t.Fatal("archive above the size limit is extracted")
+	}
+
+	if _, err = extract(t, TarOptions{MaxSize: 20}, file("a", "0123456789"), file("b", "0123456789")); err != nil {
+		t.Fatalf("archive within the size limit: %v", err)
+	}
+}
+
+func TestExtractStripAndInclude(t *testing.T) {
+	root, err := extract(t, TarOptions{StripComponents: 1, Include: []string{"etcd*", "docs"}},
+		dir("etcd-v3.5.16/"),
+		file("etcd-v3.5.16/etcd", "etcd"),
+		file("etcd-v3.5.16/etcdctl", "etcdctl"),
+		file("etcd-v3.5.16/README.md", "readme"),
+		dir("etcd-v3.5.16/docs/"),
+		file("etcd-v3.5.16/docs/a.md", "a"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range map[string]string{"etcd": "etcd", "etcdctl": "etcdctl", "docs/a.md": "a"} {
+		if b, err := os.ReadFile(filepath.Join(root, name)); err != nil || string(b) != want {
+			t.Errorf("%s = %q, %v, want %q", name, b, err, want)
+		}
+	}
+	for _, name := range []string{"README.md", "etcd-v3.5.16"} {
+		if _, err = os.Stat(filepath.Join(root, name)); !os.IsNotExist(err) {
+			t.Errorf("%s is extracted: %v", name, err)
+		}
+	}
+}
@@ -17,96 +17,140 @@ limitations under the License.
 package fetch
 
 import (
-	"archive/tar"
-	"compress/gzip"
 	"encoding/json"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+
+	"github.com/ks-tool/k8s-bootstrapper/pkg/signature"
 )
 
 type Writer func(r io.Reader) error
-type TarFilter func(dst string, tr *tar.Reader, th *tar.Header) error
 
-// ToFile saves the response body to a file.
+// BackupSuffix is appended to the name of the file replaced by Install
+const BackupSuffix = ".bak"
+
+// ToFile saves the response body to a file. The content is written to a temporary file
+// next to dst which replaces it once it's complete, so a running binary is not modified
+// and dst is never left partially written.
 func ToFile(dst string, perm os.FileMode) Writer {
 	return func(r io.Reader) error {
-		fi, err := os.OpenFile(dst, os.O_RDWR|os.O_CREATE|os.O_TRUNC, perm)
+		return writeFile(dst, perm, r, false)
+	}
+}
+
+// Install is ToFile keeping the replaced file as dst.bak, so it can be restored by Rollback
+func Install(dst string, perm os.FileMode) Writer {
+	return func(r io.Reader) error {
+		return writeFile(dst, perm, r, true)
+	}
+}
+
+// Rollback restores the file replaced by Install
+func Rollback(dst string) error {
+	return os.Rename(dst+BackupSuffix, dst)
+}
+
+func writeFile(dst string, perm os.FileMode, r io.Reader, backup bool) (err error) {
+	fi, err := os.CreateTemp(filepath.Dir(dst), "."+filepath.Base(dst)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
 		if err != nil {
+			_ = fi.Close()
+			_ = os.Remove(fi.Name())
+		}
+	}()
+
+	buf := make([]byte, 5*1024*1024)
+	if _, err = io.CopyBuffer(fi, r, buf); err != nil {
+		return err
+	}
+	if err = fi.Chmod(perm); err != nil {
+		return err
+	}
+	if err = fi.Sync(); err != nil {
+		return err
+	}
+	if err = fi.Close(); err != nil {
+		return fmt.Errorf("file %q closing failed: %v", dst, err)
+	}
+
+	if backup {
+		if err = backupFile(dst); err != nil {
 			return err
 		}
-		defer func() {
-			if e := fi.Close(); e != nil {
-				err = fmt.Errorf("file %q closing failed: %v", dst, e)
-			}
-		}()
+	}
 
-		buf := make([]byte, 5*1024*1024)
-		_, err = io.CopyBuffer(fi, r, buf)
+	return os.Rename(fi.Name(), dst)
+}
 
+// backupFile links dst to dst.bak, so the replaced file is kept when dst is renamed over
+func backupFile(dst string) error {
+	if _, err := os.Lstat(dst); os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
 		return err
 	}
-}
 
-func unTar(dst string, tr *tar.Reader, hdr *tar.Header) error {
-	target := filepath.Join(dst, hdr.Name)
+	bak := dst + BackupSuffix
+	if err := os.Remove(bak); err != nil && !os.IsNotExist(err) {
+		return err
+	}
 
-	switch hdr.Typeflag {
-	case tar.TypeDir:
-		if err := os.MkdirAll(target, 0755); err != nil {
-			return err
-		}
+	return os.Link(dst, bak)
+}
 
-	case tar.TypeReg:
-		if err := ToFile(target, os.FileMode(hdr.Mode))(tr); err != nil {
-			return err
-		}
+func JSONUnmarshal(v any) Writer {
+	return func(r io.Reader) error {
+		return json.NewDecoder(r).Decode(v)
 	}
+}
 
-	return nil
+// Discard reads the response body to the end, e.g. of health checks
+func Discard(r io.Reader) error {
+	_, err := io.Copy(io.Discard, r)
+	return err
 }
 
-// UnTar unpacks files from tar.gz archive
-func UnTar(dst string, filter ...TarFilter) Writer {
-	if filter == nil {
-		filter = []TarFilter{unTar}
+// ToBytes reads the response body into b, the size is limited to 1MiB
+func ToBytes(b *[]byte) Writer {
+	return func(r io.Reader) (err error) {
+		*b, err = io.ReadAll(io.LimitReader(r, 1<<20))
+		return err
 	}
+}
 
+// Verified passes the content to dst through the signature checker, reading fails at the end
+// of the content if the signature of subject is invalid and the policy requires it.
+// Seekable content, e.g. spooled by WithChecksum, is verified before it's passed to dst.
+func Verified(dst Writer, c *signature.Checker, subject string, m signature.Material) Writer {
 	return func(r io.Reader) error {
-		gzr, err := gzip.NewReader(r)
+		vr, err := c.NewReader(r, subject, m)
 		if err != nil {
 			return err
 		}
-		defer func() {
-			_ = gzr.Close()
-		}()
-
-		tr := tar.NewReader(gzr)
-		for {
-			hdr, err := tr.Next()
-			if err == io.EOF {
-				break
-			}
-			if err != nil {
+		defer func() { _ = vr.Close() }()
+
+		if rs, ok := r.(io.ReadSeeker); ok && c.Enabled() {
+			if _, err = io.Copy(io.Discard, vr); err != nil {
 				return err
 			}
-			if hdr == nil {
-				continue
+			if _, err = rs.Seek(0, io.SeekStart); err != nil {
+				return err
 			}
 
-			for _, f := range filter {
-				if err = f(dst, tr, hdr); err != nil {
-					return err
-				}
-			}
+			return dst(rs)
 		}
-		return nil
-	}
-}
 
-func JSONUnmarshal(v any) Writer {
-	return func(r io.Reader) error {
-		return json.NewDecoder(r).Decode(v)
+		if err = dst(vr); err != nil {
+			return err
+		}
+
+		// dst may stop reading before the end of the content, e.g. at the end of a tar archive
+		_, err = io.Copy(io.Discard, vr)
+		return err
 	}
 }
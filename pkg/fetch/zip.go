@@ -0,0 +1,120 @@
+/*
+Copyright © 2024 Alexey Shulutkov <github@shulutkov.ru>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fetch
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/ks-tool/k8s-bootstrapper/utils"
+)
+
+// unzip passes entries of the zip archive to filters. The central directory is at the end of the archive,
+// so the content is read from r if it's a seekable file, e.g. spooled by WithChecksum,
+// or it's spooled to a temporary file.
+func unzip(r io.Reader, br io.Reader, dst string, opts TarOptions, filter []TarFilter) error {
+	f, ok := r.(*os.File)
+	if ok {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			ok = false
+		}
+	}
+	if !ok {
+		spool, err := os.CreateTemp("", "fetch-*.zip")
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = spool.Close()
+			_ = os.Remove(spool.Name())
+		}()
+
+		// the spooled archive is limited as well as extracted files
+		if _, err = io.Copy(spool, io.LimitReader(br, opts.MaxSize+1)); err != nil {
+			return err
+		}
+		f = spool
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() > opts.MaxSize {
+		return fmt.Errorf("archive exceeds the size limit of %s", utils.FormatSize(opts.MaxSize))
+	}
+
+	zr, err := zip.NewReader(f, fi.Size())
+	if err != nil {
+		return err
+	}
+
+	var size int64
+	for _, zf := range zr.File {
+		if err = unzipEntry(zf, dst, opts, filter, &size); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func unzipEntry(zf *zip.File, dst string, opts TarOptions, filter []TarFilter, size *int64) error {
+	rc, err := zf.Open()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = rc.Close() }()
+
+	var link string
+	mode := zf.Mode()
+	if mode&os.ModeSymlink != 0 {
+		b, err := io.ReadAll(io.LimitReader(rc, 4096))
+		if err != nil {
+			return err
+		}
+		link = string(b)
+	}
+
+	hdr, err := tar.FileInfoHeader(zf.FileInfo(), link)
+	if err != nil {
+		return err
+	}
+	hdr.Name = zf.Name
+
+	ok, err := opts.apply(hdr)
+	if err != nil || !ok {
+		return err
+	}
+
+	if hdr.Typeflag == tar.TypeReg {
+		if *size, err = opts.addSize(*size, int64(zf.UncompressedSize64)); err != nil {
+			return err
+		}
+	}
+
+	for _, f := range filter {
+		if err = f(dst, rc, hdr); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
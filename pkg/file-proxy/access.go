@@ -0,0 +1,319 @@
+/*
+ Copyright (c) 2024 Alexey Shulutkov <github@shulutkov.ru>
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this File except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package fileproxy
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ks-tool/k8s-bootstrapper/internal/config"
+
+	"github.com/sirupsen/logrus"
+)
+
+// openPaths are served to any client, e.g. to probes of load balancers
+var openPaths = []string{"/healthz", "/readyz"}
+
+// Access restricts clients of the proxy by their networks and bearer tokens,
+// limits their concurrent requests and logs requests
+type Access struct {
+	nets        []*net.IPNet
+	tokens      []string
+	tokenFile   *tokenFile
+	limit       int
+	logRequests bool
+	log         logrus.FieldLogger
+
+	mu     sync.Mutex
+	active map[string]int
+}
+
+func NewAccess(cfg config.AccessSettings, log logrus.FieldLogger) (*Access, error) {
+	a := &Access{
+		tokens:      cfg.Tokens,
+		limit:       cfg.MaxRequestsPerClient,
+		logRequests: cfg.LogRequests,
+		log:         log,
+		active:      make(map[string]int),
+	}
+
+	for _, cidr := range cfg.AllowedCIDRs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowed CIDR %q: %v", cidr, err)
+		}
+		a.nets = append(a.nets, n)
+	}
+
+	if len(cfg.TokenFile) > 0 {
+		a.tokenFile = &tokenFile{path: cfg.TokenFile}
+		if _, err := a.tokenFile.load(); err != nil {
+			return nil, err
+		}
+	}
+
+	return a, nil
+}
+
+// Middleware checks the client before the request is passed to next
+func (a *Access) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		for _, p := range openPaths {
+			if r.URL.Path == p {
+				next.ServeHTTP(rw, r)
+				return
+			}
+		}
+
+		start := time.Now()
+		w := &statusWriter{countingWriter: countingWriter{ResponseWriter: rw}}
+		client := clientIP(r)
+		if a.logRequests {
+			defer func() {
+				a.log.WithFields(logrus.Fields{
+					"client":   client,
+					"method":   r.Method,
+					"url":      r.URL.RequestURI(),
+					"status":   w.code(),
+					"bytes":    w.n,
+					"duration": time.Since(start).Round(time.Millisecond).String(),
+				}).Info("request")
+			}()
+		}
+
+		if !isUnixSocket(r) && !a.allowed(client) {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+
+		if err := a.authenticate(r); err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="k8s-bootstrapper"`)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		if !a.acquire(client) {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "too many concurrent requests", http.StatusTooManyRequests)
+			return
+		}
+		defer a.release(client)
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientIP returns the address of the connection, forwarded headers are not trusted
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+// isUnixSocket reports whether the request is received on a unix socket, its clients are local
+func isUnixSocket(r *http.Request) bool {
+	addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	return ok && addr.Network() == "unix"
+}
+
+func (a *Access) allowed(client string) bool {
+	if len(a.nets) == 0 {
+		return true
+	}
+
+	ip := net.ParseIP(client)
+	if ip == nil {
+		return false
+	}
+
+	for _, n := range a.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (a *Access) authenticate(r *http.Request) error {
+	if len(a.tokens) == 0 && a.tokenFile == nil {
+		return nil
+	}
+
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || len(token) == 0 {
+		return errors.New("bearer token required")
+	}
+
+	if containsToken(a.tokens, token) {
+		return nil
+	}
+
+	if a.tokenFile != nil {
+		tokens, err := a.tokenFile.load()
+		if err != nil {
+			// the cached tokens are kept if the file is being replaced
+			a.log.Warnf("access: %v", err)
+		}
+		if containsToken(tokens, token) {
+			return nil
+		}
+	}
+
+	return errors.New("invalid bearer token")
+}
+
+func containsToken(tokens []string, token string) bool {
+	found := false
+	for _, t := range tokens {
+		// all tokens are compared, so the time does not reveal which one matched
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			found = true
+		}
+	}
+
+	return found
+}
+
+func (a *Access) acquire(client string) bool {
+	if a.limit <= 0 {
+		return true
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.active[client] >= a.limit {
+		return false
+	}
+	a.active[client]++
+
+	return true
+}
+
+func (a *Access) release(client string) {
+	if a.limit <= 0 {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.active[client]--; a.active[client] <= 0 {
+		delete(a.active, client)
+	}
+}
+
+// tokenFile is re-read when its modification time or size changes
+type tokenFile struct {
+	path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+	tokens  []string
+}
+
+// load returns tokens of the file, the last loaded tokens are returned with the error if it can't be read
+func (f *tokenFile) load() ([]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	fi, err := os.Stat(f.path)
+	if err != nil {
+		return f.tokens, fmt.Errorf("read token file: %v", err)
+	}
+	if fi.ModTime().Equal(f.modTime) && fi.Size() == f.size && f.tokens != nil {
+		return f.tokens, nil
+	}
+
+	tokens, err := readTokens(f.path)
+	if err != nil {
+		return f.tokens, err
+	}
+	f.tokens, f.modTime, f.size = tokens, fi.ModTime(), fi.Size()
+
+	return f.tokens, nil
+}
+
+func readTokens(path string) ([]string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read token file: %v", err)
+	}
+
+	tokens := []string{}
+	for _, line := range strings.Split(string(b), "\n") {
+		if line = strings.TrimSpace(line); len(line) > 0 && !strings.HasPrefix(line, "#") {
+			tokens = append(tokens, line)
+		}
+	}
+
+	return tokens, nil
+}
+
+// ReadTokenFile returns the first token of the file
+func ReadTokenFile(path string) (string, error) {
+	tokens, err := readTokens(path)
+	if err != nil {
+		return "", err
+	}
+	if len(tokens) == 0 {
+		return "", fmt.Errorf("no token in %s", path)
+	}
+
+	return tokens[0], nil
+}
+
+// statusWriter records the status of the response for the request log
+type statusWriter struct {
+	countingWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	return w.countingWriter.Write(b)
+}
+
+func (w *statusWriter) code() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+
+	return w.status
+}
@@ -0,0 +1,183 @@
+/*
+ Copyright (c) 2024 Alexey Shulutkov <github@shulutkov.ru>
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this File except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package fileproxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/ks-tool/k8s-bootstrapper/internal/config"
+
+	"github.com/sirupsen/logrus"
+)
+
+var platformRe = regexp.MustCompile(`^[a-z0-9_]+$`)
+
+// Artifact identifies a file served by the proxy, it's also the data of URL templates
+type Artifact struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	OS      string `json:"os"`
+	Arch    string `json:"arch"`
+}
+
+// NewArtifact returns an artifact for the default platform linux/amd64
+func NewArtifact(name, version string) Artifact {
+	return Artifact{
+		Name:    name,
+		Version: version,
+		OS:      config.DefaultOS,
+		Arch:    config.DefaultArch,
+	}
+}
+
+func (a Artifact) Platform() string {
+	return a.OS + "/" + a.Arch
+}
+
+func (a Artifact) String() string {
+	return path.Join(a.Name, a.Version, a.Platform())
+}
+
+// Validate checks that the artifact can be used as a path in the cache directory
+func (a Artifact) Validate() error {
+	for _, s := range []string{a.Name, a.Version} {
+		if len(s) == 0 || s[0] == '.' || strings.ContainsAny(s, `/\`) {
+			return fmt.Errorf("invalid artifact %q", a)
+		}
+	}
+
+	if !platformRe.MatchString(a.OS) || !platformRe.MatchString(a.Arch) {
+		return fmt.Errorf("invalid platform %q", a.Platform())
+	}
+
+	return nil
+}
+
+// slashPath is the path of the artifact in the cache directory: <version>/<os>-<arch>/<name>
+func (a Artifact) slashPath() string {
+	return path.Join(a.Version, a.OS+"-"+a.Arch, a.Name)
+}
+
+func (a Artifact) relPath() string {
+	return filepath.FromSlash(a.slashPath())
+}
+
+// Query returns the URL query selecting the platform of the artifact, it's empty for the default platform
+func (a Artifact) Query() url.Values {
+	q := make(url.Values)
+	if a.OS != config.DefaultOS {
+		q.Set("os", a.OS)
+	}
+	if a.Arch != config.DefaultArch {
+		q.Set("arch", a.Arch)
+	}
+
+	return q
+}
+
+// artifactFromQuery returns the artifact for the platform requested by os and arch query parameters
+func artifactFromQuery(name, version string, q url.Values) (Artifact, error) {
+	a := NewArtifact(name, version)
+	if v := q.Get("os"); len(v) > 0 {
+		a.OS = v
+	}
+	if v := q.Get("arch"); len(v) > 0 {
+		a.Arch = v
+	}
+
+	if err := a.Validate(); err != nil {
+		return a, &httpError{status: 400, error: err}
+	}
+
+	return a, nil
+}
+
+// Endpoints maps artifact names to endpoints, the endpoint with empty name serves all other artifacts
+type Endpoints map[string]Endpoint
+
+// DefaultEndpoints returns the built-in endpoints and the endpoints defined in the config,
+// endpoints with signature settings verify signatures of artifacts
+func DefaultEndpoints(cfg *config.Config, log logrus.FieldLogger) (Endpoints, error) {
+	gh, err := NewGithubClient(cfg.Proxy.GitHub, cfg.Proxy.VersionTTL.Duration, log)
+	if err != nil {
+		return nil, err
+	}
+
+	kube, coredns, etcd := Kube, Coredns, Etcd
+	kube.releases.Client, coredns.Client, etcd.Client = gh, gh, gh
+	endpoints := Endpoints{
+		"":        kube,
+		"coredns": coredns,
+		"etcd":    etcd,
+	}
+
+	for _, endp := range cfg.Proxy.Endpoints {
+		tmpl, err := NewTemplate(endp)
+		if err != nil {
+			return nil, err
+		}
+
+		endpoints[endp.Name] = tmpl
+	}
+
+	for name, endp := range endpoints {
+		key := name
+		if len(key) == 0 {
+			key = KubernetesEndpoint
+		}
+
+		cached := newCachedEndpoint(endp, key, cfg.Proxy.VersionTTL.Duration, log)
+		if endpoints[name], err = newSignedEndpoint(cached, key, cfg.Proxy.Signatures[key], log); err != nil {
+			return nil, err
+		}
+	}
+
+	return endpoints, nil
+}
+
+func (e Endpoints) Lookup(name string) Endpoint {
+	if endp, ok := e[name]; ok {
+		return endp
+	}
+
+	return e[""]
+}
+
+// Register adds handlers of the endpoints to mux
+func (e Endpoints) Register(mux *http.ServeMux, p *Proxy) {
+	for name, endp := range e {
+		pattern := "/"
+		label := KubernetesEndpoint
+		if len(name) > 0 {
+			pattern += name + "/"
+			label = name
+		}
+
+		h := p.Handler(label, endp)
+		mux.HandleFunc(pattern, h)
+		if len(name) > 0 {
+			// /<name> redirects to the latest version instead of /<name>/ listing versions
+			mux.HandleFunc("/"+name, h)
+		}
+	}
+}
@@ -0,0 +1,30 @@
+//go:build !linux
+
+/*
+ Copyright (c) 2024 Alexey Shulutkov <github@shulutkov.ru>
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this File except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package fileproxy
+
+import (
+	"os"
+	"time"
+)
+
+// accessTime returns the modification time of the file, touch keeps it as is, so LRU
+// eviction falls back to the download time on platforms without atime lookup
+func accessTime(fi os.FileInfo) time.Time {
+	return fi.ModTime()
+}
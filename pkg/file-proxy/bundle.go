@@ -0,0 +1,434 @@
+/*
+ Copyright (c) 2024 Alexey Shulutkov <github@shulutkov.ru>
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this File except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package fileproxy
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ks-tool/k8s-bootstrapper/pkg/signature"
+)
+
+// BundleManifestName is the name of the first entry of a bundle
+const BundleManifestName = "manifest.json"
+
+// BundleManifest describes artifacts of a bundle. A bundle is a tar archive
+// with the manifest followed by artifacts, their checksum files and verified
+// signatures laid out as in the cache directory.
+type BundleManifest struct {
+	Created   time.Time        `json:"created"`
+	Artifacts []BundleArtifact `json:"artifacts"`
+}
+
+type BundleArtifact struct {
+	Artifact
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// ExportBundle writes the cached artifacts to w as a bundle
+func (p *Proxy) ExportBundle(w io.Writer, artifacts []Artifact) error {
+	m := BundleManifest{Created: time.Now().UTC()}
+	for _, a := range artifacts {
+		ok, err := p.isCached(a)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("%s: %w", a, ErrFileNotFound)
+		}
+
+		filePath := p.filePath(a)
+		fi, err := os.Stat(filePath)
+		if err != nil {
+			return err
+		}
+		hash, err := os.ReadFile(filePath + hashFileSuffix)
+		if err != nil {
+			return err
+		}
+
+		m.Artifacts = append(m.Artifacts, BundleArtifact{Artifact: a, Size: fi.Size(), SHA256: string(hash)})
+	}
+
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(w)
+	if err = writeTarEntry(tw, BundleManifestName, m.Created, b); err != nil {
+		return err
+	}
+
+	for _, ba := range m.Artifacts {
+		if err = p.writeBundleArtifact(tw, ba, m.Created); err != nil {
+			return fmt.Errorf("%s: %v", ba.Artifact, err)
+		}
+	}
+
+	return tw.Close()
+}
+
+func (p *Proxy) writeBundleArtifact(tw *tar.Writer, ba BundleArtifact, modTime time.Time) error {
+	f, err := os.Open(p.filePath(ba.Artifact))
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+
+	err = tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     ba.slashPath(),
+		Size:     ba.Size,
+		Mode:     0644,
+		ModTime:  modTime,
+	})
+	if err != nil {
+		return err
+	}
+
+	if _, err = io.Copy(tw, f); err != nil {
+		return err
+	}
+
+	if err = writeTarEntry(tw, ba.slashPath()+hashFileSuffix, modTime, []byte(ba.SHA256)); err != nil {
+		return err
+	}
+
+	// signatures are stored next to artifacts verified by signed endpoints only
+	for _, suffix := range []string{signatureSuffix, certificateSuffix} {
+		b, err := os.ReadFile(p.filePath(ba.Artifact) + suffix)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if err = writeTarEntry(tw, ba.slashPath()+suffix, modTime, b); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func writeTarEntry(tw *tar.Writer, name string, modTime time.Time, data []byte) error {
+	err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     int64(len(data)),
+		Mode:     0644,
+		ModTime:  modTime,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = tw.Write(data)
+	return err
+}
+
+// ImportBundle loads artifacts of the bundle into the cache directory and returns them,
+// every artifact is verified against the checksum of the manifest before it is committed
+func (p *Proxy) ImportBundle(r io.Reader) ([]Artifact, error) {
+	tr := tar.NewReader(r)
+	m, err := readBundleManifest(tr)
+	if err != nil {
+		return nil, err
+	}
+
+	pending := make(map[string]BundleArtifact, len(m.Artifacts))
+	for _, ba := range m.Artifacts {
+		pending[ba.slashPath()] = ba
+	}
+
+	var imported []Artifact
+	committed := make(map[string]BundleArtifact, len(m.Artifacts))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return imported, err
+		}
+
+		switch suffix := sidecarSuffix(hdr.Name); suffix {
+		case "":
+		case hashFileSuffix:
+			// checksum files are written from the manifest
+			continue
+		default:
+			// signatures follow their artifacts
+			ba, ok := committed[strings.TrimSuffix(hdr.Name, suffix)]
+			if !ok || hdr.Typeflag != tar.TypeReg {
+				return imported, fmt.Errorf("bundle: unexpected entry %q", hdr.Name)
+			}
+			err = p.trackCacheSize(ba.Artifact, func() error { return importSidecar(tr, p.filePath(ba.Artifact)+suffix) })
+			if err != nil {
+				return imported, fmt.Errorf("%s: %w", ba.Artifact, err)
+			}
+			continue
+		}
+
+		ba, ok := pending[hdr.Name]
+		if !ok || hdr.Typeflag != tar.TypeReg {
+			return imported, fmt.Errorf("bundle: unexpected entry %q", hdr.Name)
+		}
+		delete(pending, hdr.Name)
+
+		if err = p.trackCacheSize(ba.Artifact, func() error { return p.importArtifact(tr, ba) }); err != nil {
+			return imported, fmt.Errorf("%s: %w", ba.Artifact, err)
+		}
+		imported = append(imported, ba.Artifact)
+		committed[hdr.Name] = ba
+	}
+
+	for name := range pending {
+		return imported, fmt.Errorf("bundle: entry %q not found", name)
+	}
+
+	return imported, nil
+}
+
+func (p *Proxy) importArtifact(r io.Reader, ba BundleArtifact) error {
+	if _, ok := p.flight.lookup(ba.String()); ok {
+		return errors.New("artifact is being downloaded")
+	}
+
+	filePath := p.filePath(ba.Artifact)
+	tmp, err := createTemp(filePath)
+	if err != nil {
+		return err
+	}
+	defer tmp.discard()
+
+	h := sha256.New()
+	if err = copyBuffer(io.MultiWriter(tmp, h), r); err != nil {
+		return err
+	}
+
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != ba.SHA256 {
+		return fmt.Errorf("%w: expected %s, got %s", ErrChecksumMismatch, ba.SHA256, sum)
+	}
+
+	if err = writeFileAtomic(filePath+hashFileSuffix, []byte(ba.SHA256), 0644); err != nil {
+		return err
+	}
+
+	return tmp.commit(0644)
+}
+
+func importSidecar(r io.Reader, dst string) error {
+	b, err := readSidecar(r)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(dst, b, 0644)
+}
+
+func readSidecar(r io.Reader) ([]byte, error) {
+	b, err := io.ReadAll(io.LimitReader(r, maxSignatureSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > maxSignatureSize {
+		return nil, errors.New("signature is too large")
+	}
+
+	return b, nil
+}
+
+func readBundleManifest(tr *tar.Reader) (BundleManifest, error) {
+	var m BundleManifest
+
+	hdr, err := tr.Next()
+	if err != nil {
+		return m, fmt.Errorf("bundle: read manifest: %v", err)
+	}
+	if hdr.Name != BundleManifestName {
+		return m, fmt.Errorf("bundle: expected %s as the first entry, got %q", BundleManifestName, hdr.Name)
+	}
+
+	if err = json.NewDecoder(tr).Decode(&m); err != nil {
+		return m, fmt.Errorf("bundle: decode manifest: %v", err)
+	}
+
+	for _, ba := range m.Artifacts {
+		if err = ba.Validate(); err != nil {
+			return m, fmt.Errorf("bundle: %v", err)
+		}
+		if len(ba.SHA256) != sha256.Size*2 {
+			return m, fmt.Errorf("bundle: %s: invalid checksum %q", ba.Artifact, ba.SHA256)
+		}
+	}
+
+	return m, nil
+}
+
+// Bundle gives access to artifacts of a bundle file without importing it
+type Bundle struct {
+	mu       sync.Mutex
+	f        *os.File
+	manifest BundleManifest
+}
+
+func OpenBundle(file string) (*Bundle, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := readBundleManifest(tar.NewReader(f))
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+
+	return &Bundle{f: f, manifest: m}, nil
+}
+
+func (b *Bundle) Manifest() BundleManifest {
+	return b.manifest
+}
+
+func (b *Bundle) Close() error {
+	return b.f.Close()
+}
+
+// Extract passes the content of the artifact to fn,
+// fn is not called if the content does not match the checksum of the manifest
+func (b *Bundle) Extract(a Artifact, fn func(io.Reader) error) error {
+	return b.ExtractVerified(a, nil, signature.Material{}, fn)
+}
+
+// ExtractVerified is like Extract, the content is also verified against the signature m by c
+// while the checksum is computed, fn is not called if the signature is invalid and the policy requires it
+func (b *Bundle) ExtractVerified(a Artifact, c *signature.Checker, m signature.Material, fn func(io.Reader) error) error {
+	ba, err := b.lookup(a)
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	h := sha256.New()
+	err = b.entry(ba.slashPath(), func(r io.Reader) error {
+		vr, err := c.NewReader(r, a.String(), m)
+		if err != nil {
+			return err
+		}
+		defer func() { _ = vr.Close() }()
+
+		return copyBuffer(h, vr)
+	})
+	if err != nil {
+		return err
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != ba.SHA256 {
+		return fmt.Errorf("bundle: %s: %w: expected %s, got %s", a, ErrChecksumMismatch, ba.SHA256, sum)
+	}
+
+	return b.entry(ba.slashPath(), fn)
+}
+
+// Signature returns the signature of the artifact stored in the bundle, ErrFileNotFound is returned
+// if the artifact was bundled without a signature. The certificate is optional.
+func (b *Bundle) Signature(a Artifact) (signature.Material, error) {
+	var m signature.Material
+
+	ba, err := b.lookup(a)
+	if err != nil {
+		return m, err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	err = b.entry(ba.slashPath()+signatureSuffix, func(r io.Reader) (err error) {
+		m.Signature, err = readSidecar(r)
+		return err
+	})
+	if err != nil {
+		return m, err
+	}
+
+	err = b.entry(ba.slashPath()+certificateSuffix, func(r io.Reader) (err error) {
+		m.Certificate, err = readSidecar(r)
+		return err
+	})
+	if err != nil && !errors.Is(err, ErrFileNotFound) {
+		return m, err
+	}
+
+	return m, nil
+}
+
+// Checksum returns the sha256 checksum of the artifact in the manifest
+func (b *Bundle) Checksum(a Artifact) (string, error) {
+	ba, err := b.lookup(a)
+	if err != nil {
+		return "", err
+	}
+
+	return ba.SHA256, nil
+}
+
+func (b *Bundle) lookup(a Artifact) (*BundleArtifact, error) {
+	for i := range b.manifest.Artifacts {
+		if b.manifest.Artifacts[i].Artifact == a {
+			return &b.manifest.Artifacts[i], nil
+		}
+	}
+
+	return nil, fmt.Errorf("bundle: %s: %w", a, ErrFileNotFound)
+}
+
+// entry passes the content of the named entry to fn
+func (b *Bundle) entry(name string, fn func(io.Reader) error) error {
+	if _, err := b.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	tr := tar.NewReader(b.f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return fmt.Errorf("bundle: %s: %w", name, ErrFileNotFound)
+		}
+		if err != nil {
+			return err
+		}
+
+		if hdr.Name == name {
+			return fn(tr)
+		}
+	}
+}
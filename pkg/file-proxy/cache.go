@@ -0,0 +1,413 @@
+/*
+ Copyright (c) 2024 Alexey Shulutkov <github@shulutkov.ru>
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this File except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package fileproxy
+
+import (
+	"context"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/ks-tool/k8s-bootstrapper/internal/config"
+)
+
+const (
+	ReasonMaxAge      = "max age exceeded"
+	ReasonMaxVersions = "max versions exceeded"
+	ReasonMaxSize     = "max size exceeded"
+)
+
+// CachePolicy defines which artifacts are evicted from the cache, zero values mean unlimited
+type CachePolicy struct {
+	MaxSize     int64
+	MaxVersions int
+	MaxAge      time.Duration
+	// Pinned artifacts are never evicted, patterns have the path.Match syntax and match <name>/<version>
+	Pinned []string
+	// RegistryMaxSize limits manifests and blobs of the registry separately from artifacts
+	RegistryMaxSize int64
+}
+
+func newCachePolicy(cfg *config.Config) CachePolicy {
+	cp := cfg.ControlPlain
+	return CachePolicy{
+		MaxSize:     cfg.Proxy.Cache.MaxSize.Value(),
+		MaxVersions: cfg.Proxy.Cache.MaxVersions,
+		MaxAge:      cfg.Proxy.Cache.MaxAge.Duration,
+		Pinned: append([]string{
+			"*/" + cp.KubernetesVersion,
+			"etcd/" + cp.EtcdVersion,
+			"coredns/" + cp.CorednsVersion,
+		}, cfg.Proxy.Cache.Pinned...),
+		RegistryMaxSize: cfg.Proxy.Registry.MaxSize.Value(),
+	}
+}
+
+func (cp CachePolicy) pinned(e CacheEntry) bool {
+	for _, pattern := range cp.Pinned {
+		if ok, _ := path.Match(pattern, e.Name+"/"+e.Version); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// CacheEntry is a cached artifact, the size includes the checksum and signature files.
+// Manifests and blobs of the registry have RegistryPath set instead of the artifact.
+type CacheEntry struct {
+	Artifact
+	// RegistryPath is the slash separated path in the registry directory, e.g. blobs/sha256/<hash>
+	RegistryPath string
+	Size         int64
+	LastAccess   time.Time
+	Pinned       bool
+	// Reason is set for evicted entries
+	Reason string
+}
+
+func (e CacheEntry) String() string {
+	if len(e.RegistryPath) > 0 {
+		return path.Join(registryDir, e.RegistryPath)
+	}
+
+	return e.Artifact.String()
+}
+
+// Entries lists artifacts of the cache directory laid out as <version>/<os>-<arch>/<name>
+func (p *Proxy) Entries() ([]CacheEntry, error) {
+	versions, err := readDirs(p.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var entries []CacheEntry
+	for _, version := range versions {
+		platforms, err := readDirs(filepath.Join(p.dir, version))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, platform := range platforms {
+			goos, arch, ok := strings.Cut(platform, "-")
+			if !ok {
+				continue
+			}
+
+			dir := filepath.Join(p.dir, version, platform)
+			files, err := os.ReadDir(dir)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, f := range files {
+				if !f.Type().IsRegular() || isTempFile(f.Name()) || len(sidecarSuffix(f.Name())) > 0 {
+					continue
+				}
+
+				fi, err := f.Info()
+				if err != nil {
+					return nil, err
+				}
+
+				e := CacheEntry{
+					Artifact:   Artifact{Name: f.Name(), Version: version, OS: goos, Arch: arch},
+					Size:       fi.Size() + sidecarsSize(filepath.Join(dir, f.Name())),
+					LastAccess: accessTime(fi),
+				}
+				e.Pinned = p.policy.pinned(e)
+
+				entries = append(entries, e)
+			}
+		}
+	}
+
+	return entries, nil
+}
+
+// GC removes artifacts, manifests and blobs of the registry according to the cache policy and returns them,
+// nothing is removed if dryRun is true
+func (p *Proxy) GC(dryRun bool) ([]CacheEntry, error) {
+	entries, err := p.Entries()
+	if err != nil {
+		return nil, err
+	}
+	images, err := p.registryEntries()
+	if err != nil {
+		return nil, err
+	}
+	p.metrics.setCache(entries, images)
+
+	// most recently used first
+	slices.SortFunc(entries, func(a, b CacheEntry) int {
+		return b.LastAccess.Compare(a.LastAccess)
+	})
+
+	var (
+		evicted []CacheEntry
+		total   int64
+		now     = time.Now()
+	)
+	versions := make(map[string]int)
+	kept := entries[:0]
+	for _, e := range entries {
+		key := e.Name + "/" + e.Platform()
+		versions[key]++
+
+		switch {
+		case e.Pinned:
+		case p.inFlight(e):
+			// an invalid file is being downloaded again
+		case p.policy.MaxAge > 0 && now.Sub(e.LastAccess) > p.policy.MaxAge:
+			e.Reason = ReasonMaxAge
+		case p.policy.MaxVersions > 0 && versions[key] > p.policy.MaxVersions:
+			e.Reason = ReasonMaxVersions
+		}
+
+		if len(e.Reason) > 0 {
+			versions[key]--
+			evicted = append(evicted, e)
+			continue
+		}
+
+		total += e.Size
+		kept = append(kept, e)
+	}
+
+	// least recently used first
+	for i := len(kept) - 1; i >= 0 && p.policy.MaxSize > 0 && total > p.policy.MaxSize; i-- {
+		e := kept[i]
+		if e.Pinned || p.inFlight(e) {
+			continue
+		}
+
+		e.Reason = ReasonMaxSize
+		total -= e.Size
+		evicted = append(evicted, e)
+	}
+	evicted = append(evicted, p.evictRegistry(images)...)
+
+	if dryRun {
+		return evicted, nil
+	}
+
+	for i, e := range evicted {
+		if err = p.remove(e); err != nil {
+			return evicted[:i], err
+		}
+	}
+
+	return evicted, nil
+}
+
+// RunGC collects garbage every interval until ctx is canceled, a non-positive interval disables it
+func (p *Proxy) RunGC(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		evicted, err := p.GC(false)
+		for _, e := range evicted {
+			p.log.Infof("gc: removed %s: %s", e, e.Reason)
+		}
+		if err != nil {
+			p.log.Errorf("gc: %v", err)
+		}
+	}
+}
+
+func (p *Proxy) inFlight(e CacheEntry) bool {
+	_, ok := p.flight.lookup(e.Artifact.String())
+	return ok
+}
+
+func (p *Proxy) remove(e CacheEntry) error {
+	if len(e.RegistryPath) > 0 {
+		return p.removeRegistryFile(e)
+	}
+
+	file := p.filePath(e.Artifact)
+	err := p.trackCacheSize(e.Artifact, func() error {
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		for _, suffix := range sidecarSuffixes {
+			if err := os.Remove(file + suffix); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// platform and version directories are removed only if they are empty
+	platformDir := filepath.Dir(file)
+	if err := os.Remove(platformDir); err == nil {
+		_ = os.Remove(filepath.Dir(platformDir))
+	}
+
+	return nil
+}
+
+// trackCacheSize updates the cache size metrics by the change of files of the artifact made by fn
+func (p *Proxy) trackCacheSize(a Artifact, fn func() error) error {
+	before, wasCached := p.cachedSize(a)
+	err := fn()
+	after, cached := p.cachedSize(a)
+
+	p.metrics.cacheSize.Add(float64(after - before))
+	switch {
+	case cached && !wasCached:
+		p.metrics.cacheArtifacts.Inc()
+	case !cached && wasCached:
+		p.metrics.cacheArtifacts.Dec()
+	}
+
+	return err
+}
+
+// cachedSize returns the size of the cached artifact and its sidecar files
+func (p *Proxy) cachedSize(a Artifact) (int64, bool) {
+	file := p.filePath(a)
+	fi, err := os.Stat(file)
+	if err != nil || !fi.Mode().IsRegular() {
+		return 0, false
+	}
+
+	return fi.Size() + sidecarsSize(file), true
+}
+
+func sidecarsSize(file string) int64 {
+	var size int64
+	for _, suffix := range sidecarSuffixes {
+		size += fileSize(file + suffix)
+	}
+
+	return size
+}
+
+// fileSize returns the size of the file, zero if it does not exist
+func fileSize(file string) int64 {
+	if fi, err := os.Stat(file); err == nil {
+		return fi.Size()
+	}
+
+	return 0
+}
+
+// migrateLegacyLayout moves artifacts cached as <version>/<name> before artifacts were cached per platform
+// to <version>/<os>-<arch>/<name> of the default platform, legacy artifacts already cached in the new layout are removed
+func (p *Proxy) migrateLegacyLayout() error {
+	versions, err := readDirs(p.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	platform := config.DefaultOS + "-" + config.DefaultArch
+	for _, version := range versions {
+		dir := filepath.Join(p.dir, version)
+		files, err := os.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+
+		// artifacts cached in the new layout are looked up before moving, so sidecars are removed along with them
+		var legacy []string
+		cached := make(map[string]bool)
+		for _, f := range files {
+			if !f.Type().IsRegular() || isTempFile(f.Name()) {
+				continue
+			}
+			legacy = append(legacy, f.Name())
+
+			name := strings.TrimSuffix(f.Name(), sidecarSuffix(f.Name()))
+			if _, seen := cached[name]; !seen {
+				if cached[name], err = fileIsExist(filepath.Join(dir, platform, name)); err != nil {
+					return err
+				}
+			}
+		}
+
+		for _, name := range legacy {
+			src := filepath.Join(dir, name)
+			if cached[strings.TrimSuffix(name, sidecarSuffix(name))] {
+				p.log.Infof("remove legacy cached file %s", src)
+				if err = os.Remove(src); err != nil {
+					return err
+				}
+				continue
+			}
+
+			dst := filepath.Join(dir, platform, name)
+			p.log.Infof("move legacy cached file %s to %s", src, dst)
+			if err = os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+				return err
+			}
+			if err = os.Rename(src, dst); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// readDirs returns names of not hidden subdirectories
+func readDirs(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var dirs []string
+	for _, e := range entries {
+		if e.IsDir() && !strings.HasPrefix(e.Name(), ".") {
+			dirs = append(dirs, e.Name())
+		}
+	}
+
+	return dirs, nil
+}
+
+// touch records the access time of the cached artifact
+func touch(file string) {
+	if fi, err := os.Stat(file); err == nil {
+		_ = os.Chtimes(file, time.Now(), fi.ModTime())
+	}
+}
@@ -0,0 +1,264 @@
+/*
+ Copyright (c) 2024 Alexey Shulutkov <github@shulutkov.ru>
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this File except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package fileproxy
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/ks-tool/k8s-bootstrapper/utils"
+
+	"k8s.io/apimachinery/pkg/util/version"
+)
+
+// VersionLister is implemented by endpoints able to list versions of artifacts,
+// the latest version is listed for other endpoints
+type VersionLister interface {
+	Versions(ctx context.Context) ([]string, error)
+}
+
+// Catalog lists cached artifacts
+type Catalog struct {
+	Artifacts []CatalogArtifact `json:"artifacts"`
+}
+
+// CatalogArtifact is a cached artifact, the size includes the checksum and signature files
+type CatalogArtifact struct {
+	Artifact
+	Size       int64     `json:"size"`
+	SHA256     string    `json:"sha256,omitempty"`
+	LastAccess time.Time `json:"lastAccess"`
+	Pinned     bool      `json:"pinned,omitempty"`
+}
+
+// VersionList lists versions of an artifact available in the cache and from the endpoint
+type VersionList struct {
+	Name     string        `json:"name"`
+	Versions []VersionInfo `json:"versions"`
+	// Error is set if versions of the endpoint could not be listed.
+	Error string `json:"error,omitempty"`
+}
+
+type VersionInfo struct {
+	Version string `json:"version"`
+	// Platforms are cached platforms of the version as <os>/<arch>.
+	Platforms []string `json:"platforms,omitempty"`
+	// Upstream is set if the version is available from the endpoint.
+	Upstream bool `json:"upstream,omitempty"`
+}
+
+// Catalog returns cached artifacts sorted by name, version and platform
+func (p *Proxy) Catalog() (Catalog, error) {
+	entries, err := p.Entries()
+	if err != nil {
+		return Catalog{}, err
+	}
+
+	c := Catalog{Artifacts: make([]CatalogArtifact, 0, len(entries))}
+	for _, e := range entries {
+		a := CatalogArtifact{Artifact: e.Artifact, Size: e.Size, LastAccess: e.LastAccess, Pinned: e.Pinned}
+		if b, err := os.ReadFile(p.filePath(e.Artifact) + hashFileSuffix); err == nil {
+			a.SHA256 = strings.TrimSpace(string(b))
+		}
+		c.Artifacts = append(c.Artifacts, a)
+	}
+
+	slices.SortFunc(c.Artifacts, func(a, b CatalogArtifact) int {
+		return cmp.Or(
+			strings.Compare(a.Name, b.Name),
+			compareVersions(b.Version, a.Version),
+			strings.Compare(a.OS+"/"+a.Arch, b.OS+"/"+b.Arch),
+		)
+	})
+
+	return c, nil
+}
+
+// Versions lists versions of the artifact, the latest first
+func (p *Proxy) Versions(ctx context.Context, name string, endp Endpoint) (VersionList, error) {
+	c, err := p.Catalog()
+	if err != nil {
+		return VersionList{}, err
+	}
+
+	l := VersionList{Name: name}
+	index := make(map[string]int)
+	add := func(v string) *VersionInfo {
+		i, ok := index[v]
+		if !ok {
+			i = len(l.Versions)
+			index[v] = i
+			l.Versions = append(l.Versions, VersionInfo{Version: v})
+		}
+		return &l.Versions[i]
+	}
+
+	for _, a := range c.Artifacts {
+		if a.Name == name {
+			vi := add(a.Version)
+			vi.Platforms = append(vi.Platforms, a.OS+"/"+a.Arch)
+		}
+	}
+
+	upstream, err := endpointVersions(ctx, endp)
+	if err != nil {
+		p.log.Warnf("list versions of %s: %v", name, err)
+		l.Error = err.Error()
+	}
+	for _, v := range upstream {
+		add(v).Upstream = true
+	}
+
+	slices.SortStableFunc(l.Versions, func(a, b VersionInfo) int {
+		return compareVersions(b.Version, a.Version)
+	})
+
+	return l, nil
+}
+
+func endpointVersions(ctx context.Context, endp Endpoint) ([]string, error) {
+	if e, ok := endp.(*signedEndpoint); ok {
+		endp = e.Endpoint
+	}
+
+	if vl, ok := endp.(VersionLister); ok {
+		return vl.Versions(ctx)
+	}
+
+	tag, err := endp.LastTag(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return []string{tag}, nil
+}
+
+// compareVersions compares semantic versions, other versions are compared as strings and sorted before them
+func compareVersions(a, b string) int {
+	va, errA := version.ParseGeneric(a)
+	vb, errB := version.ParseGeneric(b)
+
+	switch {
+	case errA == nil && errB == nil:
+		switch {
+		case va.LessThan(vb):
+			return -1
+		case vb.LessThan(va):
+			return 1
+		default:
+			return strings.Compare(a, b)
+		}
+	case errA == nil:
+		return 1
+	case errB == nil:
+		return -1
+	default:
+		return strings.Compare(a, b)
+	}
+}
+
+// CatalogHandler serves the catalog of cached artifacts as JSON
+func (p *Proxy) CatalogHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c, err := p.Catalog()
+		if err != nil {
+			httpErrorWriter(w, err)
+			return
+		}
+
+		writeJSON(w, c)
+	}
+}
+
+func (p *Proxy) serveVersions(ctx context.Context, w http.ResponseWriter, name string, endp Endpoint) {
+	l, err := p.Versions(ctx, name, endp)
+	if err != nil {
+		httpErrorWriter(w, err)
+		return
+	}
+
+	writeJSON(w, l)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(v)
+}
+
+var indexTemplate = template.Must(template.New("index").Funcs(template.FuncMap{
+	"bytes": utils.FormatSize,
+	"time":  func(t time.Time) string { return t.UTC().Format(time.RFC3339) },
+	"href": func(a Artifact) string {
+		u := "/" + a.Name + "/" + a.Version
+		if q := a.Query(); len(q) > 0 {
+			u += "?" + q.Encode()
+		}
+		return u
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>File proxy</title>
+<style>
+body { font-family: sans-serif; }
+td, th { padding: 2px 12px; text-align: left; }
+td.hash { font-family: monospace; font-size: smaller; }
+</style>
+</head>
+<body>
+<h1>Cached artifacts</h1>
+<p><a href="/_catalog">/_catalog</a></p>
+<table>
+<tr><th>Name</th><th>Version</th><th>Platform</th><th>Size</th><th>SHA256</th><th>Last access</th></tr>
+{{- range .Artifacts }}
+<tr>
+<td><a href="/{{ .Name }}/">{{ .Name }}</a></td>
+<td><a href="{{ href .Artifact }}">{{ .Version }}</a></td>
+<td>{{ .OS }}/{{ .Arch }}</td>
+<td>{{ bytes .Size }}</td>
+<td class="hash">{{ .SHA256 }}</td>
+<td>{{ time .LastAccess }}</td>
+</tr>
+{{- end }}
+</table>
+</body>
+</html>
+`))
+
+func (p *Proxy) serveIndex(w http.ResponseWriter) {
+	c, err := p.Catalog()
+	if err != nil {
+		httpErrorWriter(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err = indexTemplate.Execute(w, c); err != nil {
+		p.log.Warnf("index: %v", err)
+	}
+}
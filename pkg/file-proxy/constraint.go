@@ -0,0 +1,188 @@
+/*
+ Copyright (c) 2024 Alexey Shulutkov <github@shulutkov.ru>
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this File except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package fileproxy
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/version"
+)
+
+// constraintOperators are checked in order, so two-character operators go first
+var constraintOperators = []string{">=", "<=", "!=", ">", "<", "=", "~", "^"}
+
+// Constraint is a comma-separated list of version comparisons which all must match, e.g. ">=1.30, <1.32".
+// Supported operators are =, !=, >, >=, <, <=, ~ (patch releases: ~3.5 is >=3.5.0, <3.6.0) and
+// ^ (compatible releases: ^1.2.3 is >=1.2.3, <2.0.0). A version without an operator or with x or *
+// in place of a component matches its prefix, e.g. 1.30 and 1.30.x match all patches of 1.30.
+type Constraint []func(*version.Version) bool
+
+// ParseConstraint parses a version constraint
+func ParseConstraint(s string) (Constraint, error) {
+	var c Constraint
+	for _, term := range strings.Split(s, ",") {
+		term = strings.TrimSpace(term)
+		if len(term) == 0 {
+			return nil, fmt.Errorf("invalid version constraint %q: empty term", s)
+		}
+
+		fn, err := parseConstraintTerm(term)
+		if err != nil {
+			return nil, fmt.Errorf("invalid version constraint %q: %v", s, err)
+		}
+		c = append(c, fn)
+	}
+
+	return c, nil
+}
+
+// Match reports whether the version matches all comparisons of the constraint
+func (c Constraint) Match(v *version.Version) bool {
+	for _, fn := range c {
+		if !fn(v) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Latest returns the newest of versions matching the constraint, versions which can't be parsed are skipped
+func (c Constraint) Latest(versions []string) (string, bool) {
+	var latest string
+	for _, v := range versions {
+		pv, err := version.ParseGeneric(v)
+		if err != nil || !c.Match(pv) {
+			continue
+		}
+		if len(latest) == 0 || compareVersions(v, latest) > 0 {
+			latest = v
+		}
+	}
+
+	return latest, len(latest) > 0
+}
+
+func parseConstraintTerm(term string) (func(*version.Version) bool, error) {
+	var op string
+	for _, o := range constraintOperators {
+		if strings.HasPrefix(term, o) {
+			op = o
+			break
+		}
+	}
+
+	want, depth, wildcard, err := parseConstraintVersion(strings.TrimSpace(strings.TrimPrefix(term, op)))
+	if err != nil {
+		return nil, err
+	}
+
+	// a partial version is a range of the releases with its prefix: [lower, upper)
+	lower := want
+	upper := nextRelease(want, depth)
+	if wildcard && op != "" && op != "=" && op != "!=" {
+		return nil, fmt.Errorf("wildcard is not allowed with %q", op)
+	}
+
+	switch op {
+	case "", "=":
+		if depth == 3 {
+			return func(v *version.Version) bool { return sameRelease(v, want, depth) }, nil
+		}
+		return func(v *version.Version) bool { return v.AtLeast(lower) && v.LessThan(upper) }, nil
+	case "!=":
+		return func(v *version.Version) bool { return !(v.AtLeast(lower) && v.LessThan(upper)) }, nil
+	case ">":
+		return func(v *version.Version) bool { return v.AtLeast(upper) }, nil
+	case ">=":
+		return func(v *version.Version) bool { return v.AtLeast(lower) }, nil
+	case "<":
+		return func(v *version.Version) bool { return v.LessThan(lower) }, nil
+	case "<=":
+		return func(v *version.Version) bool { return v.LessThan(upper) }, nil
+	case "~":
+		// ~1 allows minor releases, ~1.2 and ~1.2.3 allow patch releases
+		if depth > 1 {
+			upper = nextRelease(want, 2)
+		}
+		return func(v *version.Version) bool { return v.AtLeast(lower) && v.LessThan(upper) }, nil
+	case "^":
+		// the first non-zero component is fixed, ^0.2.3 is >=0.2.3, <0.3.0
+		fixed := 1
+		if want.Major() == 0 && depth > 1 {
+			fixed = 2
+			if want.Minor() == 0 && depth > 2 {
+				fixed = 3
+			}
+		}
+		upper = nextRelease(want, fixed)
+		return func(v *version.Version) bool { return v.AtLeast(lower) && v.LessThan(upper) }, nil
+	}
+
+	return nil, fmt.Errorf("unknown operator in %q", term)
+}
+
+// parseConstraintVersion parses a full or partial version, missing components and x or * are zeros.
+// It returns the number of given components.
+func parseConstraintVersion(s string) (*version.Version, int, bool, error) {
+	if len(s) == 0 {
+		return nil, 0, false, errors.New("version is missing")
+	}
+
+	parts := strings.Split(strings.TrimPrefix(s, "v"), ".")
+	if len(parts) > 3 {
+		return nil, 0, false, fmt.Errorf("invalid version %q", s)
+	}
+
+	depth := len(parts)
+	wildcard := false
+	for i, p := range parts {
+		if p == "x" || p == "X" || p == "*" {
+			if i == 0 {
+				return nil, 0, false, fmt.Errorf("invalid version %q", s)
+			}
+			depth, wildcard = i, true
+			break
+		}
+	}
+
+	parts = parts[:depth]
+	for len(parts) < 3 {
+		parts = append(parts, "0")
+	}
+
+	v, err := version.ParseSemantic(strings.Join(parts, "."))
+	if err != nil {
+		return nil, 0, false, err
+	}
+
+	return v, depth, wildcard, nil
+}
+
+// nextRelease returns the first version after the releases with the first depth components of v
+func nextRelease(v *version.Version, depth int) *version.Version {
+	switch depth {
+	case 1:
+		return version.MajorMinor(v.Major()+1, 0).WithPatch(0)
+	case 2:
+		return version.MajorMinor(v.Major(), v.Minor()+1).WithPatch(0)
+	default:
+		return version.MajorMinor(v.Major(), v.Minor()).WithPatch(v.Patch() + 1)
+	}
+}
@@ -0,0 +1,277 @@
+/*
+ Copyright (c) 2024 Alexey Shulutkov <github@shulutkov.ru>
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this File except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package fileproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+)
+
+var errStreamRestarted = errors.New("download restarted from another source")
+
+// flight coalesces concurrent downloads of the same artifact into one
+type flight struct {
+	mu    sync.Mutex
+	calls map[string]*call
+}
+
+func newFlight() *flight {
+	return &flight{calls: make(map[string]*call)}
+}
+
+// lookup returns the download of the key which is in flight
+func (f *flight) lookup(key string) (*call, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	c, ok := f.calls[key]
+	return c, ok
+}
+
+// len returns the number of downloads in flight
+func (f *flight) len() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return len(f.calls)
+}
+
+// do starts fn in background unless a download of the key is already in flight.
+// The returned call is shared by all callers and is not bound to their contexts.
+func (f *flight) do(key string, fn func(*call) (string, error)) *call {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if c, ok := f.calls[key]; ok {
+		return c
+	}
+
+	c := newCall()
+	f.calls[key] = c
+
+	go func() {
+		src, err := fn(c)
+
+		f.mu.Lock()
+		delete(f.calls, key)
+		f.mu.Unlock()
+
+		c.finish(src, err)
+	}()
+
+	return c
+}
+
+// call is a download in flight. Every attempt to download the artifact from a source
+// starts a new generation, waiters can read the file of the current generation while it's being written.
+type call struct {
+	done chan struct{}
+	src  string
+	err  error
+
+	mu      sync.Mutex
+	changed chan struct{}
+	gen     int
+	attempt attempt
+}
+
+type attempt struct {
+	src  string
+	file string
+	dst  string
+	size int64
+}
+
+func newCall() *call {
+	return &call{
+		done:    make(chan struct{}),
+		changed: make(chan struct{}),
+	}
+}
+
+// begin starts a new generation writing the temporary file which is renamed to dst on success,
+// size is -1 if unknown
+func (c *call) begin(src, file, dst string, size int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gen++
+	c.attempt = attempt{src: src, file: file, dst: dst, size: size}
+	c.notify()
+}
+
+// Write notifies waiters that data was written to the file of the current generation
+func (c *call) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.notify()
+	return len(b), nil
+}
+
+func (c *call) notify() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+func (c *call) finish(src string, err error) {
+	c.src, c.err = src, err
+	close(c.done)
+}
+
+func (c *call) state() (int, attempt, <-chan struct{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.gen, c.attempt, c.changed
+}
+
+func (c *call) finished() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// wait blocks until the download is done or ctx is canceled
+func (c *call) wait(ctx context.Context) (string, error) {
+	select {
+	case <-c.done:
+		return c.src, c.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// stream sends the file to the client while it's being downloaded. It returns true
+// if the response has been started, in that case the connection must be aborted on error.
+func (c *call) stream(w http.ResponseWriter, r *http.Request) (bool, error) {
+	var (
+		f    *os.File
+		gen  int
+		off  int64
+		sent bool
+	)
+	defer func() {
+		if f != nil {
+			_ = f.Close()
+		}
+	}()
+
+	buf := make([]byte, 32*1024)
+	for {
+		finished := c.finished()
+		g, a, changed := c.state()
+
+		if g != gen {
+			if off > 0 {
+				return sent, errStreamRestarted
+			}
+
+			if f != nil {
+				_ = f.Close()
+				f = nil
+			}
+
+			fi, err := os.Open(a.file)
+			if os.IsNotExist(err) {
+				// the temporary file has been renamed on success or removed on failure
+				switch {
+				case !finished:
+					if err = c.waitChange(r.Context(), changed); err != nil {
+						return sent, err
+					}
+					continue
+				case c.err != nil:
+					return sent, c.err
+				}
+				fi, err = os.Open(a.dst)
+			}
+			if err != nil {
+				return sent, err
+			}
+			f, gen = fi, g
+		}
+
+		if f != nil {
+			for {
+				n, err := f.Read(buf)
+				if n > 0 {
+					if !sent {
+						if a.size >= 0 {
+							w.Header().Set("Content-Length", fmt.Sprintf("%d", a.size))
+						}
+						w.Header().Set("Content-Type", "application/octet-stream")
+						w.Header().Set("X-Upstream", a.src)
+						w.WriteHeader(http.StatusOK)
+						sent = true
+					}
+
+					if _, err = w.Write(buf[:n]); err != nil {
+						return sent, err
+					}
+					off += int64(n)
+				}
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					return sent, err
+				}
+			}
+
+			if fl, ok := w.(http.Flusher); ok && sent {
+				fl.Flush()
+			}
+		}
+
+		if finished {
+			if c.err != nil {
+				return sent, c.err
+			}
+			if !sent {
+				w.Header().Set("Content-Length", "0")
+				w.WriteHeader(http.StatusOK)
+				sent = true
+			}
+
+			return sent, nil
+		}
+
+		if err := c.waitChange(r.Context(), changed); err != nil {
+			return sent, err
+		}
+	}
+}
+
+func (c *call) waitChange(ctx context.Context, changed <-chan struct{}) error {
+	select {
+	case <-changed:
+	case <-c.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	return nil
+}
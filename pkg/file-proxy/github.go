@@ -18,30 +18,244 @@ package fileproxy
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
+	"os"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/ks-tool/k8s-bootstrapper/internal/config"
+
 	"github.com/google/go-github/github"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	githubPerPage = 100
+	// maxReleasePages limits listing of releases, the newest releases are listed first
+	maxReleasePages = 10
+	// defaultAbuseRetryAfter is the wait after the secondary rate limit without Retry-After
+	defaultAbuseRetryAfter = time.Minute
+)
+
+var (
+	Coredns = Github{
+		Owner: "coredns",
+		Repo:  "coredns",
+		File: func(a Artifact) string {
+			return fmt.Sprintf("coredns_%s_%s_%s.tgz", strings.TrimPrefix(a.Version, "v"), a.OS, a.Arch)
+		},
+		HashFile: func(a Artifact) string {
+			return fmt.Sprintf("coredns_%s_%s_%s.tgz.sha256", strings.TrimPrefix(a.Version, "v"), a.OS, a.Arch)
+		},
+	}
+
+	Etcd = Github{
+		Owner: "etcd-io",
+		Repo:  "etcd",
+		File: func(a Artifact) string {
+			return fmt.Sprintf("etcd-%s-%s-%s.tar.gz", a.Version, a.OS, a.Arch)
+		},
+		HashFile: func(Artifact) string { return "SHA256SUMS" },
+	}
 )
 
+// Github serves release assets of the repository. Client defaults to the client configured
+// with defaults of config.GitHubSettings, i.e. authenticated with the GITHUB_TOKEN environment variable.
 type Github struct {
 	Owner    string
 	Repo     string
-	File     func(string) string
-	HashFile func(string) string
+	File     func(Artifact) string
+	HashFile func(Artifact) string
+	Client   *GithubClient
+}
+
+// GithubClient is a GitHub API client shared by endpoints, requests exceeding the rate limit
+// wait for its reset if it's sooner than the configured maximum wait. Releases are cached by tags.
+type GithubClient struct {
+	client     *github.Client
+	timeout    time.Duration
+	maxWait    time.Duration
+	releaseTTL time.Duration
+	log        logrus.FieldLogger
+
+	mu       sync.Mutex
+	releases map[string]*cachedValue[*github.RepositoryRelease]
+}
+
+var defaultGithubClient = sync.OnceValues(func() (*GithubClient, error) {
+	var cfg config.GitHubSettings
+	config.SetGitHubDefaults(&cfg)
+
+	return NewGithubClient(cfg, config.DefaultVersionTTL, logrus.StandardLogger())
+})
+
+// NewGithubClient returns the client of github.com or GitHub Enterprise if the base URL is set,
+// the token is read from the environment variable or from the token file. Releases are cached for releaseTTL.
+func NewGithubClient(cfg config.GitHubSettings, releaseTTL time.Duration, log logrus.FieldLogger) (*GithubClient, error) {
+	token, err := githubToken(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	hc := &http.Client{Transport: http.DefaultTransport}
+	if len(token) > 0 {
+		hc.Transport = &authTransport{auth: "token " + token, next: http.DefaultTransport}
+	}
+
+	cl := github.NewClient(hc)
+	if len(cfg.BaseURL) > 0 {
+		if cl, err = github.NewEnterpriseClient(cfg.BaseURL, cfg.BaseURL, hc); err != nil {
+			return nil, fmt.Errorf("invalid GitHub base url: %v", err)
+		}
+	}
+
+	return &GithubClient{
+		client:     cl,
+		timeout:    cfg.Timeout.Duration,
+		maxWait:    cfg.MaxRateLimitWait.Duration,
+		releaseTTL: releaseTTL,
+		log:        log,
+		releases:   make(map[string]*cachedValue[*github.RepositoryRelease]),
+	}, nil
+}
+
+func githubToken(cfg config.GitHubSettings) (string, error) {
+	if len(cfg.TokenEnv) > 0 {
+		if token := strings.TrimSpace(os.Getenv(cfg.TokenEnv)); len(token) > 0 {
+			return token, nil
+		}
+	}
+
+	if len(cfg.TokenFile) == 0 {
+		return "", nil
+	}
+
+	b, err := os.ReadFile(cfg.TokenFile)
+	if err != nil {
+		return "", fmt.Errorf("read GitHub token: %v", err)
+	}
+
+	return strings.TrimSpace(string(b)), nil
+}
+
+// authTransport sets the Authorization header of requests, e.g. to the GitHub API or to an upstream proxy
+type authTransport struct {
+	auth string
+	next http.RoundTripper
+}
+
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", t.auth)
+
+	return t.next.RoundTrip(req)
+}
+
+// do calls the API, the call is repeated after the reset of the exceeded rate limit
+// until the waits exceed maxWait
+func (c *GithubClient) do(ctx context.Context, call func(ctx context.Context) error) error {
+	deadline := time.Now().Add(c.maxWait)
+	for {
+		err := c.call(ctx, call)
+		if err == nil {
+			return nil
+		}
+
+		wait, ok := rateLimitWait(err)
+		if !ok || time.Now().Add(wait).After(deadline) {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+func (c *GithubClient) call(ctx context.Context, call func(ctx context.Context) error) error {
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	return call(ctx)
+}
+
+// rateLimitWait returns the time until the reset of the exceeded rate limit
+func rateLimitWait(err error) (time.Duration, bool) {
+	var rle *github.RateLimitError
+	if errors.As(err, &rle) {
+		// the reset time has a second precision
+		return max(time.Until(rle.Rate.Reset.Time), 0) + time.Second, true
+	}
+
+	var abuse *github.AbuseRateLimitError
+	if errors.As(err, &abuse) {
+		if abuse.RetryAfter != nil {
+			return *abuse.RetryAfter, true
+		}
+
+		return defaultAbuseRetryAfter, true
+	}
+
+	return 0, false
+}
+
+// release returns the cached release of the tag, releases failed to fetch are not cached
+func (c *GithubClient) release(ctx context.Context, owner, repo, tag string) (*github.RepositoryRelease, error) {
+	key := owner + "/" + repo + "@" + tag
+
+	c.mu.Lock()
+	cv, ok := c.releases[key]
+	if !ok {
+		cv = &cachedValue[*github.RepositoryRelease]{ttl: c.releaseTTL, log: c.log.WithField("release", key)}
+		c.releases[key] = cv
+	}
+	c.mu.Unlock()
+
+	rel, err := cv.get(ctx, func(ctx context.Context) (rel *github.RepositoryRelease, err error) {
+		err = c.do(ctx, func(ctx context.Context) error {
+			rel, _, err = c.client.Repositories.GetReleaseByTag(ctx, owner, repo, tag)
+			return err
+		})
+		return rel, err
+	})
+	if err != nil && !cv.cached() {
+		c.mu.Lock()
+		if c.releases[key] == cv {
+			delete(c.releases, key)
+		}
+		c.mu.Unlock()
+	}
+
+	return rel, err
 }
 
-func (gh Github) getUrl(tag, filename string) (string, error) {
-	cl := github.NewClient(http.DefaultClient)
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+func (gh Github) client() (*GithubClient, error) {
+	if gh.Client != nil {
+		return gh.Client, nil
+	}
+
+	return defaultGithubClient()
+}
 
-	rel, err := wrapper(cl.Repositories.GetReleaseByTag(ctx, gh.Owner, gh.Repo, tag))
+func (gh Github) getUrl(ctx context.Context, tag, filename string) (string, error) {
+	cl, err := gh.client()
 	if err != nil {
 		return "", err
 	}
 
+	rel, err := cl.release(ctx, gh.Owner, gh.Repo, tag)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch release: %w", err)
+	}
+
 	for _, asset := range rel.Assets {
 		if *asset.Name == filename {
 			return *asset.BrowserDownloadURL, nil
@@ -51,35 +265,86 @@ func (gh Github) getUrl(tag, filename string) (string, error) {
 	return "", ErrFileNotFound
 }
 
-func (gh Github) FileURL(_, tag string) (string, error) {
-	return gh.getUrl(tag, gh.File(tag))
+func (gh Github) FileURL(ctx context.Context, a Artifact) (string, error) {
+	return gh.getUrl(ctx, a.Version, gh.File(a))
 }
 
-func (gh Github) HashFileURL(_, tag string) (string, error) {
-	return gh.getUrl(tag, gh.HashFile(tag))
+func (gh Github) HashFileURL(ctx context.Context, a Artifact) (string, error) {
+	return gh.getUrl(ctx, a.Version, gh.HashFile(a))
 }
 
-func (gh Github) LastTag() (string, error) {
-	cl := github.NewClient(http.DefaultClient)
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
-	rel, err := wrapper(cl.Repositories.GetLatestRelease(ctx, gh.Owner, gh.Repo))
+func (gh Github) LastTag(ctx context.Context) (string, error) {
+	cl, err := gh.client()
 	if err != nil {
 		return "", err
 	}
 
+	var rel *github.RepositoryRelease
+	err = cl.do(ctx, func(ctx context.Context) (err error) {
+		rel, _, err = cl.client.Repositories.GetLatestRelease(ctx, gh.Owner, gh.Repo)
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch release: %w", err)
+	}
+
 	return *rel.TagName, nil
 }
 
-func wrapper(rel *github.RepositoryRelease, resp *github.Response, err error) (*github.RepositoryRelease, error) {
+// Versions lists tags of releases excluding drafts and pre-releases, the newest first
+func (gh Github) Versions(ctx context.Context) ([]string, error) {
+	cl, err := gh.client()
 	if err != nil {
-		if resp != nil {
-			return nil, fmt.Errorf("failed to fetch release: %s: %s", resp, err)
+		return nil, err
+	}
+
+	var versions []string
+	opts := &github.ListOptions{PerPage: githubPerPage}
+	for page := 0; page < maxReleasePages; page++ {
+		var (
+			rels []*github.RepositoryRelease
+			resp *github.Response
+		)
+		err = cl.do(ctx, func(ctx context.Context) (err error) {
+			rels, resp, err = cl.client.Repositories.ListReleases(ctx, gh.Owner, gh.Repo, opts)
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list releases: %w", err)
 		}
 
-		return nil, err
+		for _, rel := range rels {
+			if rel.GetDraft() || rel.GetPrerelease() {
+				continue
+			}
+			versions = append(versions, rel.GetTagName())
+		}
+
+		if resp.NextPage == 0 {
+			break
+		}
+		opts.Page = resp.NextPage
+	}
+
+	return versions, nil
+}
+
+// LatestMatching returns the tag of the newest release matching the version constraint, e.g. ~3.5
+func (gh Github) LatestMatching(ctx context.Context, constraint string) (string, error) {
+	c, err := ParseConstraint(constraint)
+	if err != nil {
+		return "", err
+	}
+
+	versions, err := gh.Versions(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	latest, ok := c.Latest(versions)
+	if !ok {
+		return "", fmt.Errorf("no release of %s/%s matches %q", gh.Owner, gh.Repo, constraint)
 	}
 
-	return rel, nil
+	return latest, nil
 }
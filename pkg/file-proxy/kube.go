@@ -22,38 +22,58 @@ import (
 	"io"
 	"strings"
 	"time"
+
+	"k8s.io/apimachinery/pkg/util/version"
 )
 
 const (
-	k8sUrlPattern    = "https://dl.k8s.io/%s/bin/linux/amd64/%s"
+	k8sUrlPattern    = "https://dl.k8s.io/%s/bin/%s/%s/%s"
 	latestVersionUrl = "https://dl.k8s.io/release/stable-1.txt"
 )
 
-var Kube kube = ""
+var Kube = kube{releases: Github{Owner: "kubernetes", Repo: "kubernetes"}}
 
-type kube string
+type kube struct {
+	// releases lists versions of Kubernetes, dl.k8s.io has no index
+	releases Github
+}
 
-func (k kube) FileURL(file, tag string) (string, error) {
-	return fmt.Sprintf(k8sUrlPattern, tag, file), nil
+func (k kube) FileURL(_ context.Context, a Artifact) (string, error) {
+	return fmt.Sprintf(k8sUrlPattern, a.Version, a.OS, a.Arch, a.Name), nil
 }
 
-func (k kube) HashFileURL(file, tag string) (string, error) {
-	return k.FileURL(file+hashFileSuffix, tag)
+func (k kube) HashFileURL(ctx context.Context, a Artifact) (string, error) {
+	a.Name += hashFileSuffix
+	return k.FileURL(ctx, a)
 }
 
-func (k kube) LastTag() (string, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+func (k kube) LastTag(ctx context.Context) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
 	resp, err := get(ctx, latestVersionUrl)
 	if err != nil {
 		return "", err
 	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("fetch last tag failed: expected 200 response code, got %d", resp.StatusCode)
+	}
 
-	b, err := io.ReadAll(resp.Body)
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 1024))
 	if err != nil {
 		return "", err
 	}
 
-	return strings.TrimSpace(string(b)), nil
+	tag := strings.TrimSpace(string(b))
+	if _, err = version.ParseGeneric(tag); err != nil {
+		return "", fmt.Errorf("fetch last tag failed: %v", err)
+	}
+
+	return tag, nil
+}
+
+func (k kube) Versions(ctx context.Context) ([]string, error) {
+	return k.releases.Versions(ctx)
 }
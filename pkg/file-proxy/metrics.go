@@ -0,0 +1,187 @@
+/*
+ Copyright (c) 2024 Alexey Shulutkov <github@shulutkov.ru>
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this File except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package fileproxy
+
+import (
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "fileproxy"
+
+// downloadDurationBuckets are upper bounds in seconds of the upstream download duration histogram
+var downloadDurationBuckets = []float64{0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600}
+
+// metrics of the proxy, every proxy has its own registry as the embedded proxy may run
+// in the same process as other proxies
+type metrics struct {
+	registry       *prometheus.Registry
+	requests       *prometheus.CounterVec
+	servedBytes    *prometheus.CounterVec
+	failures       *prometheus.CounterVec
+	mismatches     *prometheus.CounterVec
+	downloadTime   *prometheus.HistogramVec
+	cacheSize      prometheus.Gauge
+	registrySize   prometheus.Gauge
+	cacheArtifacts prometheus.Gauge
+}
+
+func newMetrics(p *Proxy) *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "cache_requests_total",
+			Help:      "Requests of artifacts by endpoint and result, hit if the artifact is cached or miss.",
+		}, []string{"endpoint", "result"}),
+		servedBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "served_bytes_total",
+			Help:      "Bytes of artifacts served to clients by endpoint.",
+		}, []string{"endpoint"}),
+		failures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "upstream_failures_total",
+			Help:      "Failed downloads of artifacts by source.",
+		}, []string{"source"}),
+		mismatches: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "checksum_mismatches_total",
+			Help:      "Downloads of artifacts not matching their checksums by source.",
+		}, []string{"source"}),
+		downloadTime: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "upstream_download_duration_seconds",
+			Help:      "Duration of successful downloads of artifacts by source.",
+			Buckets:   downloadDurationBuckets,
+		}, []string{"source"}),
+		cacheSize: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "cache_size_bytes",
+			Help:      "Total size of cached artifacts and their sidecar files.",
+		}),
+		registrySize: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "registry_size_bytes",
+			Help:      "Total size of cached manifests and blobs of the registry.",
+		}),
+		cacheArtifacts: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "cache_artifacts",
+			Help:      "Number of cached artifacts.",
+		}),
+	}
+
+	m.registry.MustRegister(
+		m.requests,
+		m.servedBytes,
+		m.failures,
+		m.mismatches,
+		m.downloadTime,
+		m.cacheSize,
+		m.registrySize,
+		m.cacheArtifacts,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "downloads_in_flight",
+			Help:      "Number of artifacts being downloaded.",
+		}, func() float64 {
+			return float64(p.flight.len())
+		}),
+	)
+
+	return m
+}
+
+// setCache sets the cache and registry sizes to the totals of listed entries
+func (m *metrics) setCache(entries, images []CacheEntry) {
+	var size, registrySize int64
+	for _, e := range entries {
+		size += e.Size
+	}
+	for _, e := range images {
+		registrySize += e.Size
+	}
+
+	m.cacheSize.Set(float64(size))
+	m.registrySize.Set(float64(registrySize))
+	m.cacheArtifacts.Set(float64(len(entries)))
+}
+
+// MetricsHandler serves metrics of the proxy in the Prometheus text format
+func (p *Proxy) MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(p.metrics.registry, promhttp.HandlerOpts{})
+}
+
+// HealthzHandler reports that the proxy is running
+func HealthzHandler(w http.ResponseWriter, _ *http.Request) {
+	_, _ = io.WriteString(w, "ok")
+}
+
+// ReadyzHandler reports whether the proxy is able to cache artifacts
+func (p *Proxy) ReadyzHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := p.ready(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+
+		_, _ = io.WriteString(w, "ok")
+	}
+}
+
+// ready checks that the assets directory is writable
+func (p *Proxy) ready() error {
+	if err := os.MkdirAll(p.dir, 0755); err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(p.dir, ".ready.*"+tempFileSuffix)
+	if err != nil {
+		return err
+	}
+	_ = f.Close()
+
+	return os.Remove(f.Name())
+}
+
+// countingWriter counts bytes of the response body
+type countingWriter struct {
+	http.ResponseWriter
+	n int64
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.n += int64(n)
+	return n, err
+}
+
+// Flush lets downloads in flight be streamed to clients
+func (w *countingWriter) Flush() {
+	if fl, ok := w.ResponseWriter.(http.Flusher); ok {
+		fl.Flush()
+	}
+}
+
+func (w *countingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
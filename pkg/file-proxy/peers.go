@@ -0,0 +1,152 @@
+/*
+ Copyright (c) 2024 Alexey Shulutkov <github@shulutkov.ru>
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this File except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package fileproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxPeers limits the number of listed nodes, announcements of new nodes are rejected above it
+const maxPeers = 4096
+
+// Peer is a node sharing verified artifacts
+type Peer struct {
+	// URL is the base URL the node serves artifacts on.
+	URL string `json:"url"`
+	// LastSeen is the time of the last announcement of the node.
+	LastSeen time.Time `json:"lastSeen,omitempty"`
+}
+
+// PeerList is the list of nodes served by /_peers
+type PeerList struct {
+	Peers []Peer `json:"peers"`
+}
+
+// Peers is the registry of nodes sharing artifacts. Nodes announce themselves with PUT /_peers
+// and are listed by GET /_peers until the TTL passes since the last announcement, DELETE /_peers
+// removes the node when it stops sharing.
+type Peers struct {
+	ttl time.Duration
+
+	mu    sync.Mutex
+	peers map[string]time.Time
+}
+
+func NewPeers(ttl time.Duration) *Peers {
+	return &Peers{ttl: ttl, peers: make(map[string]time.Time)}
+}
+
+// List returns nodes announced within the TTL sorted by their URLs
+func (p *Peers) List() PeerList {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.expire()
+
+	l := PeerList{Peers: make([]Peer, 0, len(p.peers))}
+	for u, seen := range p.peers {
+		l.Peers = append(l.Peers, Peer{URL: u, LastSeen: seen})
+	}
+	slices.SortFunc(l.Peers, func(a, b Peer) int {
+		return strings.Compare(a.URL, b.URL)
+	})
+
+	return l
+}
+
+func (p *Peers) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		writeJSON(w, p.List())
+	case http.MethodPut, http.MethodDelete:
+		peerURL, err := readPeerURL(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if r.Method == http.MethodDelete {
+			p.remove(peerURL)
+		} else if !p.announce(peerURL) {
+			http.Error(w, "too many peers", http.StatusServiceUnavailable)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// announce records the node, it returns false if the registry is full
+func (p *Peers) announce(peerURL string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, ok := p.peers[peerURL]; !ok && len(p.peers) >= maxPeers {
+		p.expire()
+		if len(p.peers) >= maxPeers {
+			return false
+		}
+	}
+	p.peers[peerURL] = time.Now()
+
+	return true
+}
+
+func (p *Peers) remove(peerURL string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.peers, peerURL)
+}
+
+// expire removes nodes not announced within the TTL, the lock must be held
+func (p *Peers) expire() {
+	for u, seen := range p.peers {
+		if time.Since(seen) > p.ttl {
+			delete(p.peers, u)
+		}
+	}
+}
+
+// readPeerURL reads the Peer of the request body and returns its URL without the trailing slash
+func readPeerURL(r io.Reader) (string, error) {
+	var peer Peer
+	if err := json.NewDecoder(io.LimitReader(r, 4096)).Decode(&peer); err != nil {
+		return "", fmt.Errorf("invalid peer: %v", err)
+	}
+
+	u, err := url.Parse(peer.URL)
+	if err != nil {
+		return "", fmt.Errorf("invalid peer url: %v", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 || u.User != nil ||
+		len(u.RawQuery) > 0 || len(u.Fragment) > 0 {
+		return "", fmt.Errorf("invalid peer url %q", peer.URL)
+	}
+
+	return strings.TrimSuffix(u.String(), "/"), nil
+}
@@ -0,0 +1,100 @@
+/*
+ Copyright (c) 2024 Alexey Shulutkov <github@shulutkov.ru>
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this File except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package fileproxy
+
+import (
+	"context"
+	"os"
+	"sync"
+)
+
+// PrefetchResult is the result of prefetching an artifact
+type PrefetchResult struct {
+	Artifact
+	// Source is the name of the source which served the artifact, it's empty if the artifact was cached
+	Source string
+	Err    error
+}
+
+// Prefetch populates the cache with artifacts running at most concurrency downloads at once
+func (p *Proxy) Prefetch(ctx context.Context, endpoints Endpoints, artifacts []Artifact, concurrency int) []PrefetchResult {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	results := make([]PrefetchResult, len(artifacts))
+	sem := make(chan struct{}, concurrency)
+
+	var wg sync.WaitGroup
+	for i, a := range artifacts {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			case <-ctx.Done():
+				results[i] = PrefetchResult{Artifact: a, Err: ctx.Err()}
+				return
+			}
+
+			src, err := p.Fetch(ctx, endpoints.Lookup(a.Name), a)
+			results[i] = PrefetchResult{Artifact: a, Source: src, Err: err}
+		}()
+	}
+	wg.Wait()
+
+	return results
+}
+
+// Fetch downloads the artifact into the cache unless a valid copy is already cached,
+// it returns the name of the source which served the artifact or empty string if it was cached.
+// The download is bound to ctx.
+func (p *Proxy) Fetch(ctx context.Context, endp Endpoint, a Artifact) (string, error) {
+	ok, err := p.isCached(a)
+	if err != nil || ok {
+		return "", err
+	}
+
+	return p.download(ctx, endp, a).wait(ctx)
+}
+
+// isCached checks that the artifact is cached and matches its checksum, invalid files are removed
+func (p *Proxy) isCached(a Artifact) (bool, error) {
+	if _, ok := p.flight.lookup(a.String()); ok {
+		return false, nil
+	}
+
+	filePath := p.filePath(a)
+	if ok, err := fileIsExist(filePath); err != nil || !ok {
+		return false, err
+	}
+
+	hash, err := os.ReadFile(filePath + hashFileSuffix)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+
+	if ok, err := validateSha256Hash(filePath, string(hash)); err != nil || ok {
+		return ok, err
+	}
+
+	p.log.Warnf("cached %s does not match its checksum", a)
+
+	return false, p.remove(CacheEntry{Artifact: a})
+}
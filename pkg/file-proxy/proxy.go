@@ -27,9 +27,15 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/ks-tool/k8s-bootstrapper/internal/config"
+	"github.com/ks-tool/k8s-bootstrapper/pkg/fetch"
+	"github.com/ks-tool/k8s-bootstrapper/pkg/signature"
+
+	"github.com/mitchellh/go-homedir"
+	"github.com/sirupsen/logrus"
 )
 
 const (
@@ -40,12 +46,13 @@ var (
 	ErrIsNotRegularFile = errors.New("not a regular File")
 	ErrNotImplemented   = errors.New("not implemented")
 	ErrFileNotFound     = errors.New("file not found")
+	ErrChecksumMismatch = errors.New("checksum mismatch")
 )
 
 type Endpoint interface {
-	FileURL(string, string) (string, error)
-	HashFileURL(string, string) (string, error)
-	LastTag() (string, error)
+	FileURL(context.Context, Artifact) (string, error)
+	HashFileURL(context.Context, Artifact) (string, error)
+	LastTag(ctx context.Context) (string, error)
 }
 
 type httpError struct {
@@ -58,98 +65,174 @@ func (e *httpError) Error() string {
 }
 
 type Proxy struct {
-	dir string
-	sem *Semaphore
+	dir       string
+	flight    *flight
+	upstreams []*upstream
+	policy    CachePolicy
+	metrics   *metrics
+	log       logrus.FieldLogger
 }
 
-func NewProxy(cfg *config.Config) *Proxy {
-	return &Proxy{
-		dir: cfg.AssetsDir,
-		sem: NewSemaphore(),
+func NewProxy(cfg *config.Config, log logrus.FieldLogger) (*Proxy, error) {
+	upstreams := make([]*upstream, len(cfg.Proxy.Upstreams))
+	for i, u := range cfg.Proxy.Upstreams {
+		var err error
+		if upstreams[i], err = newUpstream(u); err != nil {
+			return nil, err
+		}
+	}
+
+	dir, err := homedir.Expand(cfg.AssetsDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to expand path: %v", err)
+	}
+
+	p := &Proxy{
+		dir:       dir,
+		flight:    newFlight(),
+		upstreams: upstreams,
+		policy:    newCachePolicy(cfg),
+		log:       log,
 	}
+	p.metrics = newMetrics(p)
+
+	return p, nil
 }
 
-// Handler handle request url /binary-name[/version]
+// Handler handle request url /binary-name[/version[.sha256|.sig|.cert]][?os=linux&arch=amd64]
+// / -> HTML index of cached artifacts
+// /coredns/ -> versions of the artifact, cached and available from the endpoint
+// /coredns -> redirect to the latest version
+// /etcd/latest-3.5, /kubectl/stable-1.30 -> redirect to the newest release of the version, see resolveAlias
+// /etcd/~3.5, /kubectl/>=1.30,<1.32 -> redirect to the newest release matching the constraint, see Constraint
 // /coredns/v1.10.0 -> pattern - /coredns/
 // /etcd/v3.14.5 -> pattern - /etcd/
 // /kubectl/v1.31.1 -> pattern - /
-func (p *Proxy) Handler(endp Endpoint) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
+// /kubectl/v1.31.1?arch=arm64 -> platform of the file, defaults to linux/amd64
+// /kubectl/v1.31.1.sha256 -> checksum of the file, lets proxies be chained as upstreams
+// /kubectl/v1.31.1.sig -> verified signature of the file, .cert is its signing certificate
+// The name of the endpoint labels its metrics.
+func (p *Proxy) Handler(name string, endp Endpoint) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
 		switch r.Method {
 		case http.MethodGet, http.MethodHead:
 		default:
-			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			http.Error(rw, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
 			return
 		}
 
+		w := &countingWriter{ResponseWriter: rw}
+		defer func() { p.metrics.servedBytes.WithLabelValues(name).Add(float64(w.n)) }()
+
 		reqPath := path.Clean(r.URL.Path)
 		if len(reqPath) > 0 && reqPath[0] == '/' {
 			reqPath = reqPath[1:]
 		}
 
-		if len(reqPath) == 0 || reqPath[0] == '.' || strings.HasSuffix(reqPath, hashFileSuffix) {
+		if len(reqPath) == 0 && r.URL.Path == "/" {
+			p.serveIndex(w)
+			return
+		}
+
+		if len(reqPath) == 0 || reqPath[0] == '.' {
 			http.NotFound(w, nil)
 			return
 		}
 
+		sidecar := sidecarSuffix(reqPath)
+		hashRequested := sidecar == hashFileSuffix
+		reqPath = strings.TrimSuffix(reqPath, sidecar)
+
 		reqPathParts := strings.Split(reqPath, "/")
 		filename := reqPathParts[0]
-		version := reqPathParts[1]
 
 		reqFileLen := len(reqPathParts[1:])
-		if reqFileLen == 1 {
-			latestVersion, err := endp.LastTag()
+		if reqFileLen == 0 && len(sidecar) == 0 && strings.HasSuffix(r.URL.Path, "/") {
+			p.serveVersions(r.Context(), w, filename, endp)
+			return
+		} else if reqFileLen == 0 && len(sidecar) == 0 {
+			latestVersion, err := endp.LastTag(r.Context())
 			if err != nil {
 				httpErrorWriter(w, err)
 				return
 			}
 
-			redirectPath := path.Join(filename, latestVersion)
+			redirectPath := "/" + path.Join(filename, latestVersion)
+			if len(r.URL.RawQuery) > 0 {
+				redirectPath += "?" + r.URL.RawQuery
+			}
 			http.Redirect(w, r, redirectPath, http.StatusTemporaryRedirect)
 			return
-		} else if reqFileLen > 2 {
+		} else if reqFileLen != 1 {
 			http.NotFound(w, nil)
 			return
 		}
 
-		reqFileRelPath := filepath.Join(version, filename)
+		if isAlias(reqPathParts[1]) {
+			v, err := resolveAlias(r.Context(), endp, reqPathParts[1])
+			if err != nil {
+				httpErrorWriter(w, err)
+				return
+			}
 
-		filePath := filepath.Join(p.dir, reqFileRelPath)
-		hashFilePath := filePath + hashFileSuffix
+			redirectPath := "/" + path.Join(filename, v) + sidecar
+			if len(r.URL.RawQuery) > 0 {
+				redirectPath += "?" + r.URL.RawQuery
+			}
+			http.Redirect(w, r, redirectPath, http.StatusTemporaryRedirect)
+			return
+		}
 
-		reqFileIsExist, err := fileIsExist(filePath)
+		artifact, err := artifactFromQuery(filename, reqPathParts[1], r.URL.Query())
 		if err != nil {
 			httpErrorWriter(w, err)
 			return
 		}
 
-		if !reqFileIsExist && r.Method == http.MethodGet {
-			download := func() error {
-				p.sem.Acquire(reqPath)
-				defer p.sem.Release(reqPath)
+		filePath := p.filePath(artifact)
+		hashFilePath := filePath + hashFileSuffix
+
+		c, inFlight := p.flight.lookup(artifact.String())
 
-				url, err := endp.HashFileURL(filename, version)
-				if err != nil {
-					return err
-				}
+		var reqFileIsExist bool
+		if !inFlight {
+			if reqFileIsExist, err = fileIsExist(filePath); err != nil {
+				httpErrorWriter(w, err)
+				return
+			}
+		}
 
-				if err = p.fetchHash(r.Context(), url, hashFilePath); err != nil {
-					return err
-				}
+		if len(sidecar) == 0 {
+			result := "hit"
+			if !reqFileIsExist {
+				result = "miss"
+			}
+			p.metrics.requests.WithLabelValues(name, result).Inc()
+		}
 
-				url, err = endp.FileURL(filename, version)
-				if err != nil {
-					return err
+		if !reqFileIsExist {
+			// the download is shared by concurrent requests and must not be canceled when one of them is gone
+			ctx := context.WithoutCancel(r.Context())
+			c = p.download(ctx, endp, artifact)
+
+			// range and conditional requests are served when the file is complete
+			if len(sidecar) == 0 && r.Method == http.MethodGet && !isPartialOrConditional(r) {
+				if sent, err := c.stream(w, r); err != nil {
+					if sent {
+						panic(http.ErrAbortHandler)
+					}
+					httpErrorWriter(w, err)
 				}
-
-				return p.fetchFile(r.Context(), url, filePath)
+				return
 			}
 
-			if err = download(); err != nil {
+			src, err := c.wait(r.Context())
+			if err != nil {
 				httpErrorWriter(w, err)
 				return
 			}
 
+			w.Header().Set("X-Upstream", src)
 			reqFileIsExist = true
 		}
 
@@ -172,7 +255,7 @@ func (p *Proxy) Handler(endp Endpoint) http.HandlerFunc {
 
 		fileIsValid := true
 		if len(hash) > 0 {
-			w.Header().Set("ETag", hash)
+			w.Header().Set("ETag", `"`+hash+`"`)
 
 			fileIsValid, err = validateSha256Hash(filePath, hash)
 			if err != nil {
@@ -181,81 +264,139 @@ func (p *Proxy) Handler(endp Endpoint) http.HandlerFunc {
 			}
 		}
 
-		if r.Method == http.MethodHead {
-			if fileIsValid && reqFileIsExist {
-				fs, _ := os.Stat(filePath)
-				w.Header().Set("Content-Length", fmt.Sprintf("%d", fs.Size()))
+		if hashRequested {
+			if !fileIsValid || len(hash) == 0 {
+				http.NotFound(w, nil)
+				return
 			}
-			w.Header().Set("Content-Type", "application/octet-stream")
+
+			// nodes downloading the artifact from peers trust the size of the proxy only
+			if fi, err := os.Stat(filePath); err == nil {
+				w.Header().Set(fetch.ArtifactSizeHeader, strconv.FormatInt(fi.Size(), 10))
+			}
+			w.Header().Del("ETag")
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			_, _ = io.WriteString(w, hash)
 			return
 		}
 
-		if !fileIsValid {
-			if err = os.Remove(filePath); err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+		if len(sidecar) > 0 {
+			if ok, err := fileIsExist(filePath + sidecar); !fileIsValid || err != nil || !ok {
+				httpErrorWriter(w, err)
 				return
 			}
 
-			if hashFileIsExist {
-				if err = os.Remove(hashFilePath); err != nil {
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-					return
-				}
+			w.Header().Del("ETag")
+			serveFile(w, r, filePath+sidecar)
+			return
+		}
+
+		if !fileIsValid {
+			if err = p.remove(CacheEntry{Artifact: artifact}); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
 			}
 
-			http.Redirect(w, r, r.URL.Path, http.StatusTemporaryRedirect)
+			http.Redirect(w, r, r.URL.RequestURI(), http.StatusTemporaryRedirect)
 			return
 		}
 
-		sendFile(w, filePath)
+		touch(filePath)
+		serveFile(w, r, filePath)
 	}
 }
 
-func (p *Proxy) fetchHash(ctx context.Context, url, filePath string) error {
-	resp, err := p.download(ctx, url)
-	if err != nil {
-		return err
-	}
+func (p *Proxy) filePath(a Artifact) string {
+	return filepath.Join(p.dir, a.relPath())
+}
 
-	checksum, err := io.ReadAll(resp.Body)
+// download starts the download of the artifact or joins the download in flight
+func (p *Proxy) download(ctx context.Context, endp Endpoint, a Artifact) *call {
+	return p.flight.do(a.String(), func(c *call) (string, error) {
+		return p.fetch(ctx, endp, a, c)
+	})
+}
+
+// fetchHash downloads the checksum file and returns the sha256 hash of the remote file filename.
+// The checksum file contains either a single hash or lines in the sha256sum format.
+func (s source) fetchHash(ctx context.Context, url, filename string) (string, error) {
+	resp, err := s.download(ctx, url)
 	if err != nil {
-		return err
+		return "", err
 	}
+	defer func() { _ = resp.Body.Close() }()
 
-	if err = os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
-		return err
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
 	}
 
-	if len(checksum) == 64 {
-		return os.WriteFile(filePath, checksum, 0644)
+	checksum := strings.TrimSpace(string(b))
+	if len(checksum) == sha256.Size*2 {
+		return strings.ToLower(checksum), nil
 	}
 
-	filename := filepath.Base(filePath)
-	lines := strings.Split(string(checksum), "\n")
+	lines := strings.Split(checksum, "\n")
 	for _, line := range lines {
-		if strings.Contains(line, filename) {
-			hash := []byte(strings.SplitN(line, " ", 2)[0])
-			return os.WriteFile(filePath, hash, 0644)
+		fields := strings.Fields(line)
+		if len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == filename {
+			return strings.ToLower(fields[0]), nil
 		}
 	}
 
-	return fmt.Errorf("hashsum for File %q not found", filename)
+	return "", fmt.Errorf("hashsum for File %q not found", filename)
 }
 
-func (p *Proxy) fetchFile(ctx context.Context, url, filePath string) error {
-	resp, err := p.download(ctx, url)
+// fetchFile downloads the file into a temporary file, verifies it against the checksum and the signature
+// if it's given and atomically moves it and its checksum and signature files into the cache
+func (s source) fetchFile(ctx context.Context, url, filePath, checksum string, sig *signature.Material, c *call) error {
+	resp, err := s.download(ctx, url)
 	if err != nil {
 		return err
 	}
+	defer func() { _ = resp.Body.Close() }()
 
-	if err = os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+	tmp, err := createTemp(filePath)
+	if err != nil {
 		return err
 	}
+	defer tmp.discard()
 
-	return writeToFile(filePath, resp.Body, 0644)
+	c.begin(s.name, tmp.Name(), filePath, resp.ContentLength)
+
+	h := sha256.New()
+	if err = copyBuffer(io.MultiWriter(tmp, h, c), resp.Body); err != nil {
+		return err
+	}
+
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != checksum {
+		return fmt.Errorf("%w: expected %s, got %s", ErrChecksumMismatch, checksum, sum)
+	}
+
+	if sig != nil {
+		err = s.checker.VerifyFile(tmp.Name(), *sig)
+		if err == nil {
+			err = writeSignature(filePath, *sig)
+		}
+		if err = s.checker.Check(url, err); err != nil {
+			return err
+		}
+	}
+
+	if err = writeFileAtomic(filePath+hashFileSuffix, []byte(checksum), 0644); err != nil {
+		return err
+	}
+
+	return tmp.commit(0644)
 }
-func (p *Proxy) download(ctx context.Context, url string) (*http.Response, error) {
-	resp, err := get(ctx, url)
+
+func (s source) download(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.client.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -272,44 +413,39 @@ func (p *Proxy) download(ctx context.Context, url string) (*http.Response, error
 	return resp, nil
 }
 
-func writeToFile(dst string, src io.Reader, perm os.FileMode) error {
-	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
-		return err
-	}
-
-	fi, err := os.OpenFile(dst, os.O_RDWR|os.O_CREATE|os.O_TRUNC, perm)
-	if err != nil {
-		return err
-	}
-	defer func() {
-		if e := fi.Close(); e != nil {
-			err = fmt.Errorf("file %q closing failed: %v", dst, e)
-		}
-	}()
-
-	return copyBuffer(fi, src)
-}
-
 func copyBuffer(dst io.Writer, src io.Reader) error {
 	buf := make([]byte, 5*1024*1024)
 	_, err := io.CopyBuffer(dst, src, buf)
 	return err
 }
 
-func sendFile(w http.ResponseWriter, file string) {
+// serveFile sends the file with support of HEAD, range and conditional requests
+func serveFile(w http.ResponseWriter, r *http.Request, file string) {
 	f, err := os.Open(file)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		httpErrorWriter(w, err)
 		return
 	}
 	defer func() { _ = f.Close() }()
 
-	fs, _ := f.Stat()
-	w.Header().Set("Content-Length", fmt.Sprintf("%d", fs.Size()))
+	fs, err := f.Stat()
+	if err != nil {
+		httpErrorWriter(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, r, "", fs.ModTime(), f)
+}
 
-	if err = copyBuffer(w, f); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+func isPartialOrConditional(r *http.Request) bool {
+	for _, h := range []string{"Range", "If-Range", "If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since"} {
+		if len(r.Header.Get(h)) > 0 {
+			return true
+		}
 	}
+
+	return false
 }
 
 // validateSha256Hash calculate sha256 hash of a File and compare with hash argument
@@ -379,6 +515,9 @@ func httpErrorWriter(w http.ResponseWriter, err error) {
 	case errors.Is(err, ErrNotImplemented):
 		status = http.StatusNotImplemented
 		msg = err.Error()
+	case errors.Is(err, ErrChecksumMismatch), errors.Is(err, signature.ErrVerification):
+		status = http.StatusBadGateway
+		msg = err.Error()
 	case errors.As(err, &e):
 		status = e.status
 		msg = e.error.Error()
@@ -401,5 +540,5 @@ func get(ctx context.Context, url string) (*http.Response, error) {
 		return nil, err
 	}
 
-	return http.DefaultClient.Do(req)
+	return originClient.Do(req)
 }
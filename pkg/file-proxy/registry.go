@@ -0,0 +1,639 @@
+/*
+ Copyright (c) 2024 Alexey Shulutkov <github@shulutkov.ru>
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this File except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package fileproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/ks-tool/k8s-bootstrapper/internal/config"
+)
+
+const (
+	// registryDir is the directory of the assets directory where images are stored, images are not listed
+	// in the catalog and are evicted by the garbage collector according to the registry size limit
+	registryDir = "oci"
+	// registryEndpoint labels metrics of the registry
+	registryEndpoint = "registry"
+
+	maxManifestSize    = 4 << 20
+	mediaTypeSuffix    = ".mediatype"
+	defaultContentType = "application/octet-stream"
+)
+
+var manifestMediaTypes = []string{
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+}
+
+var (
+	// repositoryRe and tagRe are grammars of the OCI distribution spec
+	repositoryRe = regexp.MustCompile(`^[a-z0-9]+((\.|_|__|-+)[a-z0-9]+)*(/[a-z0-9]+((\.|_|__|-+)[a-z0-9]+)*)*$`)
+	tagRe        = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9._-]{0,127}$`)
+	digestRe     = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+)
+
+// Registry is a read-only OCI distribution pull-through cache. Manifests and blobs are stored by their digests,
+// tags are resolved to digests of manifests and revalidated with the upstream registry after the tag TTL.
+type Registry struct {
+	p       *Proxy
+	dir     string
+	mirrors []*registryMirror
+	tagTTL  time.Duration
+}
+
+func NewRegistry(p *Proxy, cfg config.RegistrySettings) (*Registry, error) {
+	if len(cfg.Mirrors) == 0 {
+		return nil, errors.New("registry: no mirrors defined")
+	}
+
+	mirrors := make([]*registryMirror, len(cfg.Mirrors))
+	for i, m := range cfg.Mirrors {
+		var err error
+		if mirrors[i], err = newRegistryMirror(m, cfg.Timeout.Duration); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Registry{
+		p:       p,
+		dir:     filepath.Join(p.dir, registryDir),
+		mirrors: mirrors,
+		tagTTL:  cfg.TagTTL.Duration,
+	}, nil
+}
+
+// ociError is an error response of the OCI distribution API
+type ociError struct {
+	status  int
+	code    string
+	message string
+}
+
+func (e *ociError) Error() string {
+	return fmt.Sprintf("%s: %s", e.code, e.message)
+}
+
+// ServeHTTP handles request urls of the OCI distribution API
+// /v2/ -> API version check
+// /v2/<repository>/manifests/<tag|digest>[?ns=registry.k8s.io] -> manifest of the image
+// /v2/<repository>/blobs/<digest>[?ns=registry.k8s.io] -> layer or config of the image
+func (reg *Registry) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	w := &countingWriter{ResponseWriter: rw}
+	defer func() { reg.p.metrics.servedBytes.WithLabelValues(registryEndpoint).Add(float64(w.n)) }()
+
+	w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+	default:
+		writeOCIError(w, &ociError{status: http.StatusMethodNotAllowed, code: "UNSUPPORTED", message: "the registry is read-only"})
+		return
+	}
+
+	reqPath := strings.TrimPrefix(r.URL.Path, "/v2/")
+	if len(reqPath) == 0 {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, "{}")
+		return
+	}
+
+	repo, kind, ref, ok := parseRegistryPath(reqPath)
+	if !ok {
+		writeOCIError(w, &ociError{status: http.StatusNotFound, code: "UNSUPPORTED", message: "unsupported request"})
+		return
+	}
+	if !repositoryRe.MatchString(repo) {
+		writeOCIError(w, &ociError{status: http.StatusBadRequest, code: "NAME_INVALID", message: fmt.Sprintf("invalid repository name %q", repo)})
+		return
+	}
+
+	m := reg.mirror(r.URL.Query().Get("ns"))
+	if m == nil {
+		writeOCIError(w, &ociError{status: http.StatusNotFound, code: "NAME_UNKNOWN", message: fmt.Sprintf("registry %q is not mirrored", r.URL.Query().Get("ns"))})
+		return
+	}
+
+	if kind == "manifests" {
+		reg.serveManifest(w, r, m, repo, ref)
+	} else {
+		reg.serveBlob(w, r, m, repo, ref)
+	}
+}
+
+// parseRegistryPath splits <repository>/(manifests|blobs)/<reference>, the repository may have slashes
+func parseRegistryPath(p string) (string, string, string, bool) {
+	for _, kind := range []string{"manifests", "blobs"} {
+		if i := strings.LastIndex(p, "/"+kind+"/"); i > 0 {
+			ref := p[i+len(kind)+2:]
+			if len(ref) > 0 && !strings.Contains(ref, "/") {
+				return p[:i], kind, ref, true
+			}
+		}
+	}
+
+	return "", "", "", false
+}
+
+// mirror returns the mirror of the registry host, the first mirror if the host is empty
+func (reg *Registry) mirror(host string) *registryMirror {
+	if len(host) == 0 {
+		return reg.mirrors[0]
+	}
+
+	for _, m := range reg.mirrors {
+		if m.host == host {
+			return m
+		}
+	}
+
+	return nil
+}
+
+func (reg *Registry) blobPath(digest string) string {
+	alg, hash, _ := strings.Cut(digest, ":")
+	return filepath.Join(reg.dir, "blobs", alg, hash)
+}
+
+func (reg *Registry) manifestPath(digest string) string {
+	alg, hash, _ := strings.Cut(digest, ":")
+	return filepath.Join(reg.dir, "manifests", alg, hash)
+}
+
+func (reg *Registry) tagPath(m *registryMirror, repo, tag string) string {
+	return filepath.Join(reg.dir, "tags", m.host, filepath.FromSlash(repo), tag)
+}
+
+func (reg *Registry) serveManifest(w http.ResponseWriter, r *http.Request, m *registryMirror, repo, ref string) {
+	var (
+		digest  string
+		fetched bool
+	)
+	switch {
+	case digestRe.MatchString(ref):
+		digest = ref
+	case tagRe.MatchString(ref):
+		var err error
+		if digest, fetched, err = reg.resolveTag(r.Context(), m, repo, ref); err != nil {
+			writeOCIError(w, registryError(err, "MANIFEST_UNKNOWN"))
+			return
+		}
+	default:
+		writeOCIError(w, &ociError{status: http.StatusBadRequest, code: "MANIFEST_INVALID", message: fmt.Sprintf("invalid reference %q", ref)})
+		return
+	}
+
+	file := reg.manifestPath(digest)
+	ok, err := fileIsExist(file)
+	if err != nil {
+		writeOCIError(w, err)
+		return
+	}
+
+	result := "hit"
+	if fetched {
+		result = "miss"
+	}
+	if !ok {
+		result = "miss"
+		if _, err = reg.fetchManifest(r.Context(), m, repo, digest); err != nil {
+			writeOCIError(w, registryError(err, "MANIFEST_UNKNOWN"))
+			return
+		}
+	}
+	reg.p.metrics.requests.WithLabelValues(registryEndpoint, result).Inc()
+
+	mediaType, err := os.ReadFile(file + mediaTypeSuffix)
+	if err != nil {
+		writeOCIError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", string(mediaType))
+	w.Header().Set("Docker-Content-Digest", digest)
+	w.Header().Set("ETag", `"`+digest+`"`)
+	touch(file)
+	serveContent(w, r, file)
+}
+
+// resolveTag returns the digest of the tagged manifest and whether the manifest has been downloaded.
+// The tag is revalidated with the registry after the TTL, the cached digest is returned if the registry is unreachable.
+func (reg *Registry) resolveTag(ctx context.Context, m *registryMirror, repo, tag string) (string, bool, error) {
+	file := reg.tagPath(m, repo, tag)
+
+	var cached string
+	if fi, err := os.Stat(file); err == nil {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return "", false, err
+		}
+		cached = strings.TrimSpace(string(b))
+		if time.Since(fi.ModTime()) < reg.tagTTL && digestRe.MatchString(cached) {
+			return cached, false, nil
+		}
+	}
+
+	digest, err := reg.fetchManifest(ctx, m, repo, tag)
+	if err != nil {
+		if len(cached) == 0 || ctx.Err() != nil {
+			return "", false, err
+		}
+
+		var e *httpError
+		if errors.As(err, &e) && e.status == http.StatusNotFound {
+			return "", false, err
+		}
+
+		reg.p.log.Warnf("revalidate %s/%s:%s failed, cached manifest is served: %v", m.host, repo, tag, err)
+		return cached, false, nil
+	}
+
+	return digest, digest != cached, nil
+}
+
+// fetchManifest downloads the manifest by tag or digest, verifies and stores it and returns its digest.
+// Concurrent requests of the same manifest share the download.
+func (reg *Registry) fetchManifest(ctx context.Context, m *registryMirror, repo, ref string) (string, error) {
+	c := reg.p.flight.do("manifest:"+m.host+"/"+repo+"@"+ref, func(*call) (string, error) {
+		// the download is shared by concurrent requests and must not be canceled when one of them is gone
+		ctx := context.WithoutCancel(ctx)
+
+		start := time.Now()
+		digest, err := reg.downloadManifest(ctx, m, repo, ref)
+		if err != nil {
+			reg.p.metrics.failures.WithLabelValues(m.url).Inc()
+			if errors.Is(err, ErrChecksumMismatch) {
+				reg.p.metrics.mismatches.WithLabelValues(m.url).Inc()
+			}
+			reg.p.log.Warnf("fetch manifest %s/%s:%s failed: %v", m.host, repo, ref, err)
+
+			return "", err
+		}
+		reg.p.metrics.downloadTime.WithLabelValues(m.url).Observe(time.Since(start).Seconds())
+
+		return digest, nil
+	})
+
+	return c.wait(ctx)
+}
+
+func (reg *Registry) downloadManifest(ctx context.Context, m *registryMirror, repo, ref string) (string, error) {
+	header := http.Header{"Accept": {strings.Join(manifestMediaTypes, ", ")}}
+	resp, err := m.get(ctx, repo, "manifests/"+ref, header)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	b, err := io.ReadAll(io.LimitReader(resp.Body, maxManifestSize+1))
+	if err != nil {
+		return "", err
+	}
+	if len(b) > maxManifestSize {
+		return "", fmt.Errorf("manifest exceeds %d bytes", maxManifestSize)
+	}
+
+	sum := sha256.Sum256(b)
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+	expected := resp.Header.Get("Docker-Content-Digest")
+	if digestRe.MatchString(ref) {
+		expected = ref
+	}
+	if strings.HasPrefix(expected, "sha256:") && expected != digest {
+		return "", fmt.Errorf("%w: expected %s, got %s", ErrChecksumMismatch, expected, digest)
+	}
+
+	mediaType := manifestMediaType(resp.Header.Get("Content-Type"), b)
+	if len(mediaType) == 0 {
+		return "", fmt.Errorf("manifest %s has no media type", digest)
+	}
+
+	file := reg.manifestPath(digest)
+	err = reg.p.trackRegistrySize(file, func() error {
+		if err := writeFileAtomic(file+mediaTypeSuffix, []byte(mediaType), 0644); err != nil {
+			return err
+		}
+		return writeFileAtomic(file, b, 0644)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if !digestRe.MatchString(ref) {
+		if err = writeFileAtomic(reg.tagPath(m, repo, ref), []byte(digest), 0644); err != nil {
+			return "", err
+		}
+	}
+
+	reg.p.log.Infof("manifest %s/%s:%s served by %s", m.host, repo, ref, m.url)
+
+	return digest, nil
+}
+
+// manifestMediaType returns the media type of the response or the mediaType field of the manifest
+func manifestMediaType(contentType string, b []byte) string {
+	if mt, _, err := mime.ParseMediaType(contentType); err == nil && mt != defaultContentType && mt != "text/plain" {
+		return mt
+	}
+
+	var manifest struct {
+		MediaType string `json:"mediaType"`
+	}
+	if err := json.Unmarshal(b, &manifest); err != nil {
+		return ""
+	}
+
+	return manifest.MediaType
+}
+
+func (reg *Registry) serveBlob(w http.ResponseWriter, r *http.Request, m *registryMirror, repo, digest string) {
+	if !digestRe.MatchString(digest) {
+		writeOCIError(w, &ociError{status: http.StatusBadRequest, code: "DIGEST_INVALID", message: fmt.Sprintf("unsupported digest %q", digest)})
+		return
+	}
+
+	w.Header().Set("Docker-Content-Digest", digest)
+	w.Header().Set("ETag", `"`+digest+`"`)
+
+	file := reg.blobPath(digest)
+	c, inFlight := reg.p.flight.lookup("blob:" + digest)
+
+	var ok bool
+	if !inFlight {
+		var err error
+		if ok, err = fileIsExist(file); err != nil {
+			writeOCIError(w, err)
+			return
+		}
+	}
+
+	if ok {
+		reg.p.metrics.requests.WithLabelValues(registryEndpoint, "hit").Inc()
+		touch(file)
+		serveContent(w, r, file)
+		return
+	}
+	reg.p.metrics.requests.WithLabelValues(registryEndpoint, "miss").Inc()
+
+	// the download is shared by concurrent requests and must not be canceled when one of them is gone
+	ctx := context.WithoutCancel(r.Context())
+	c = reg.p.flight.do("blob:"+digest, func(c *call) (string, error) {
+		start := time.Now()
+		if err := reg.downloadBlob(ctx, m, repo, digest, file, c); err != nil {
+			reg.p.metrics.failures.WithLabelValues(m.url).Inc()
+			if errors.Is(err, ErrChecksumMismatch) {
+				reg.p.metrics.mismatches.WithLabelValues(m.url).Inc()
+			}
+			reg.p.log.Warnf("fetch blob %s/%s@%s failed: %v", m.host, repo, digest, err)
+
+			return "", err
+		}
+		reg.p.metrics.downloadTime.WithLabelValues(m.url).Observe(time.Since(start).Seconds())
+		reg.p.log.Infof("blob %s/%s@%s served by %s", m.host, repo, digest, m.url)
+
+		return m.url, nil
+	})
+
+	// range and conditional requests are served when the blob is complete
+	if r.Method == http.MethodGet && !isPartialOrConditional(r) {
+		if sent, err := c.stream(w, r); err != nil {
+			if sent {
+				panic(http.ErrAbortHandler)
+			}
+			writeOCIError(w, registryError(err, "BLOB_UNKNOWN"))
+		}
+		return
+	}
+
+	if _, err := c.wait(r.Context()); err != nil {
+		writeOCIError(w, registryError(err, "BLOB_UNKNOWN"))
+		return
+	}
+
+	serveContent(w, r, file)
+}
+
+// downloadBlob downloads the blob into a temporary file and moves it into the cache if it matches the digest
+func (reg *Registry) downloadBlob(ctx context.Context, m *registryMirror, repo, digest, file string, c *call) error {
+	resp, err := m.get(ctx, repo, "blobs/"+digest, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	tmp, err := createTemp(file)
+	if err != nil {
+		return err
+	}
+	defer tmp.discard()
+
+	c.begin(m.url, tmp.Name(), file, resp.ContentLength)
+
+	h := sha256.New()
+	if err = copyBuffer(io.MultiWriter(tmp, h, c), resp.Body); err != nil {
+		return err
+	}
+
+	if sum := "sha256:" + hex.EncodeToString(h.Sum(nil)); sum != digest {
+		return fmt.Errorf("%w: expected %s, got %s", ErrChecksumMismatch, digest, sum)
+	}
+
+	return reg.p.trackRegistrySize(file, func() error { return tmp.commit(0644) })
+}
+
+// registryEntries lists manifests and blobs of the registry laid out as (manifests|blobs)/<alg>/<hash>,
+// the size of a manifest includes its media type file
+func (p *Proxy) registryEntries() ([]CacheEntry, error) {
+	var entries []CacheEntry
+	for _, kind := range []string{"manifests", "blobs"} {
+		dir := filepath.Join(p.dir, registryDir, kind)
+		err := filepath.WalkDir(dir, func(file string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !d.Type().IsRegular() || isTempFile(d.Name()) || strings.HasSuffix(d.Name(), mediaTypeSuffix) {
+				return nil
+			}
+
+			fi, err := d.Info()
+			if err != nil {
+				return err
+			}
+
+			rel, err := filepath.Rel(filepath.Join(p.dir, registryDir), file)
+			if err != nil {
+				return err
+			}
+
+			entries = append(entries, CacheEntry{
+				RegistryPath: filepath.ToSlash(rel),
+				Size:         fi.Size() + fileSize(file+mediaTypeSuffix),
+				LastAccess:   accessTime(fi),
+			})
+
+			return nil
+		})
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	return entries, nil
+}
+
+// evictRegistry returns the least recently used manifests and blobs exceeding the registry size limit,
+// blobs being downloaded are kept
+func (p *Proxy) evictRegistry(entries []CacheEntry) []CacheEntry {
+	if p.policy.RegistryMaxSize <= 0 {
+		return nil
+	}
+
+	var total int64
+	for _, e := range entries {
+		total += e.Size
+	}
+
+	// least recently used first
+	slices.SortFunc(entries, func(a, b CacheEntry) int {
+		return a.LastAccess.Compare(b.LastAccess)
+	})
+
+	var evicted []CacheEntry
+	for _, e := range entries {
+		if total <= p.policy.RegistryMaxSize {
+			break
+		}
+
+		if kind, digest, _ := strings.Cut(e.RegistryPath, "/"); kind == "blobs" {
+			if _, ok := p.flight.lookup("blob:" + strings.Replace(digest, "/", ":", 1)); ok {
+				continue
+			}
+		}
+
+		e.Reason = ReasonMaxSize
+		total -= e.Size
+		evicted = append(evicted, e)
+	}
+
+	return evicted
+}
+
+// removeRegistryFile removes the manifest or blob, tags resolved to a removed manifest
+// are served by downloading the manifest again
+func (p *Proxy) removeRegistryFile(e CacheEntry) error {
+	file := filepath.Join(p.dir, registryDir, filepath.FromSlash(e.RegistryPath))
+	return p.trackRegistrySize(file, func() error {
+		for _, f := range []string{file, file + mediaTypeSuffix} {
+			if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// trackRegistrySize updates the registry size metric by the change of the manifest or blob made by fn
+func (p *Proxy) trackRegistrySize(file string, fn func() error) error {
+	before := fileSize(file) + fileSize(file+mediaTypeSuffix)
+	err := fn()
+	after := fileSize(file) + fileSize(file+mediaTypeSuffix)
+
+	p.metrics.registrySize.Add(float64(after - before))
+
+	return err
+}
+
+// serveContent sends the file with support of HEAD, range and conditional requests,
+// the Content-Type header is kept if it's set
+func serveContent(w http.ResponseWriter, r *http.Request, file string) {
+	if len(w.Header().Get("Content-Type")) == 0 {
+		w.Header().Set("Content-Type", defaultContentType)
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		writeOCIError(w, err)
+		return
+	}
+	defer func() { _ = f.Close() }()
+
+	fi, err := f.Stat()
+	if err != nil {
+		writeOCIError(w, err)
+		return
+	}
+
+	http.ServeContent(w, r, "", fi.ModTime(), f)
+}
+
+// registryError converts errors of the upstream registry, code is used if the content is unknown to the registry
+func registryError(err error, code string) *ociError {
+	var (
+		oe *ociError
+		he *httpError
+	)
+	switch {
+	case errors.As(err, &oe):
+		return oe
+	case errors.Is(err, ErrChecksumMismatch):
+		return &ociError{status: http.StatusBadGateway, code: "DIGEST_INVALID", message: err.Error()}
+	case errors.As(err, &he) && he.status == http.StatusNotFound:
+		return &ociError{status: http.StatusNotFound, code: code, message: "unknown to the registry"}
+	case errors.As(err, &he):
+		return &ociError{status: http.StatusBadGateway, code: "UNKNOWN", message: fmt.Sprintf("registry responded %d: %s", he.status, he.error)}
+	default:
+		return &ociError{status: http.StatusBadGateway, code: "UNKNOWN", message: err.Error()}
+	}
+}
+
+func writeOCIError(w http.ResponseWriter, err error) {
+	var e *ociError
+	if !errors.As(err, &e) {
+		e = &ociError{status: http.StatusInternalServerError, code: "UNKNOWN", message: err.Error()}
+	}
+
+	var body bytes.Buffer
+	_ = json.NewEncoder(&body).Encode(map[string]any{
+		"errors": []map[string]string{{"code": e.code, "message": e.message}},
+	})
+
+	h := w.Header()
+	h.Del("Docker-Content-Digest")
+	h.Del("ETag")
+	h.Set("Content-Type", "application/json")
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(e.status)
+	_, _ = w.Write(body.Bytes())
+}
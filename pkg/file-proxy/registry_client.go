@@ -0,0 +1,287 @@
+/*
+ Copyright (c) 2024 Alexey Shulutkov <github@shulutkov.ru>
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this File except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package fileproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ks-tool/k8s-bootstrapper/internal/config"
+)
+
+const (
+	// defaultTokenTTL is used if the token response has no expires_in, it's the minimum required by the spec
+	defaultTokenTTL = 60 * time.Second
+	maxTokenSize    = 1 << 20
+)
+
+// registryMirror is an upstream registry, it requests bearer tokens on the challenge of the registry
+// and caches them by scope
+type registryMirror struct {
+	host     string
+	url      string
+	username string
+	password string
+	client   *http.Client
+
+	mu     sync.Mutex
+	tokens map[string]registryToken
+}
+
+type registryToken struct {
+	token   string
+	expires time.Time
+}
+
+func newRegistryMirror(cfg config.RegistryMirror, timeout time.Duration) (*registryMirror, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid registry url %q: %v", cfg.URL, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid registry url %q: unsupported scheme %q", cfg.URL, u.Scheme)
+	}
+
+	m := &registryMirror{
+		host:     cfg.Host,
+		url:      strings.TrimSuffix(u.String(), "/"),
+		username: cfg.Username,
+		tokens:   make(map[string]registryToken),
+	}
+
+	if len(cfg.PasswordFile) > 0 {
+		b, err := os.ReadFile(cfg.PasswordFile)
+		if err != nil {
+			return nil, fmt.Errorf("registry %q: read password: %v", cfg.Host, err)
+		}
+		m.password = strings.TrimSpace(string(b))
+	}
+
+	dialer := &net.Dialer{Timeout: timeout}
+
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.DialContext = dialer.DialContext
+	tr.TLSHandshakeTimeout = timeout
+	tr.ResponseHeaderTimeout = timeout
+	m.client = &http.Client{
+		Transport: tr,
+		// blobs are redirected to storage buckets which must not receive the token of the registry
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			if req.URL.Host != via[0].URL.Host {
+				req.Header.Del("Authorization")
+			}
+
+			return nil
+		},
+	}
+
+	return m, nil
+}
+
+// get requests /v2/<repo>/<path> of the registry, the request is repeated with a token if the registry challenges it
+func (m *registryMirror) get(ctx context.Context, repo, path string, header http.Header) (*http.Response, error) {
+	scope := "repository:" + repo + ":pull"
+
+	resp, err := m.do(ctx, repo, path, header, m.cachedToken(scope))
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		challenge := resp.Header.Get("WWW-Authenticate")
+		_ = resp.Body.Close()
+
+		auth, err := m.authorize(ctx, challenge, scope)
+		if err != nil {
+			return nil, fmt.Errorf("authorize to registry %s: %w", m.host, err)
+		}
+
+		if resp, err = m.do(ctx, repo, path, header, auth); err != nil {
+			return nil, err
+		}
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		defer func() { _ = resp.Body.Close() }()
+
+		msg := http.StatusText(resp.StatusCode)
+		if b, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<16)); len(bytes.TrimSpace(b)) > 0 {
+			msg = string(bytes.TrimSpace(b))
+		}
+
+		return nil, &httpError{status: resp.StatusCode, error: errors.New(msg)}
+	}
+
+	return resp, nil
+}
+
+func (m *registryMirror) do(ctx context.Context, repo, path string, header http.Header, auth string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", m.url+"/v2/"+repo+"/"+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if len(auth) > 0 {
+		req.Header.Set("Authorization", auth)
+	}
+
+	return m.client.Do(req)
+}
+
+func (m *registryMirror) cachedToken(scope string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, ok := m.tokens[scope]
+	if !ok || time.Now().After(t.expires) {
+		return ""
+	}
+
+	return "Bearer " + t.token
+}
+
+// authorize returns the Authorization header answering the challenge, Basic challenges are answered
+// with credentials of the mirror, Bearer challenges with a token of the scope
+func (m *registryMirror) authorize(ctx context.Context, challenge, scope string) (string, error) {
+	scheme, params := parseChallenge(challenge)
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if len(m.username) == 0 {
+			return "", errors.New("registry requires credentials")
+		}
+		req := &http.Request{Header: make(http.Header)}
+		req.SetBasicAuth(m.username, m.password)
+
+		return req.Header.Get("Authorization"), nil
+	case "bearer":
+	default:
+		return "", fmt.Errorf("unsupported authentication challenge %q", challenge)
+	}
+
+	realm := params["realm"]
+	if len(realm) == 0 {
+		return "", errors.New("bearer challenge without realm")
+	}
+
+	u, err := url.Parse(realm)
+	if err != nil {
+		return "", fmt.Errorf("invalid token realm %q: %v", realm, err)
+	}
+	q := u.Query()
+	if service := params["service"]; len(service) > 0 {
+		q.Set("service", service)
+	}
+	q.Set("scope", scope)
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if len(m.username) > 0 {
+		req.SetBasicAuth(m.username, m.password)
+	}
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", &httpError{status: resp.StatusCode, error: fmt.Errorf("token request failed: %s", resp.Status)}
+	}
+
+	var tr struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err = json.NewDecoder(io.LimitReader(resp.Body, maxTokenSize)).Decode(&tr); err != nil {
+		return "", fmt.Errorf("invalid token response: %v", err)
+	}
+
+	token := tr.Token
+	if len(token) == 0 {
+		token = tr.AccessToken
+	}
+	if len(token) == 0 {
+		return "", errors.New("token response without token")
+	}
+
+	ttl := defaultTokenTTL
+	if tr.ExpiresIn > 0 {
+		ttl = time.Duration(tr.ExpiresIn) * time.Second
+	}
+
+	m.mu.Lock()
+	// the token is renewed before it expires on the way to the registry
+	m.tokens[scope] = registryToken{token: token, expires: time.Now().Add(ttl * 9 / 10)}
+	m.mu.Unlock()
+
+	return "Bearer " + token, nil
+}
+
+// parseChallenge parses the WWW-Authenticate header, e.g. Bearer realm="https://auth.docker.io/token",service="registry.docker.io"
+func parseChallenge(s string) (string, map[string]string) {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(s), " ")
+	params := make(map[string]string)
+
+	for rest = strings.TrimSpace(rest); len(rest) > 0; rest = strings.TrimSpace(rest) {
+		key, value, ok := strings.Cut(rest, "=")
+		if !ok {
+			break
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+
+		if strings.HasPrefix(value, `"`) {
+			var b strings.Builder
+			i := 1
+			for ; i < len(value) && value[i] != '"'; i++ {
+				if value[i] == '\\' && i+1 < len(value) {
+					i++
+				}
+				b.WriteByte(value[i])
+			}
+			params[key] = b.String()
+			rest = strings.TrimPrefix(strings.TrimSpace(value[min(i+1, len(value)):]), ",")
+		} else {
+			v, tail, _ := strings.Cut(value, ",")
+			params[key] = strings.TrimSpace(v)
+			rest = tail
+		}
+	}
+
+	return scheme, params
+}
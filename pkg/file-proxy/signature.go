@@ -0,0 +1,179 @@
+/*
+ Copyright (c) 2024 Alexey Shulutkov <github@shulutkov.ru>
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this File except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package fileproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"text/template"
+
+	"github.com/ks-tool/k8s-bootstrapper/internal/config"
+	"github.com/ks-tool/k8s-bootstrapper/pkg/signature"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	signatureSuffix   = ".sig"
+	certificateSuffix = ".cert"
+
+	// KubernetesEndpoint is the key of signature settings of the endpoint serving Kubernetes binaries
+	KubernetesEndpoint = "kubernetes"
+
+	maxSignatureSize = 1 << 20
+)
+
+// sidecarSuffixes are suffixes of files stored next to a cached artifact
+var sidecarSuffixes = []string{hashFileSuffix, signatureSuffix, certificateSuffix}
+
+// sidecarSuffix returns the suffix of the file stored next to an artifact or empty string
+func sidecarSuffix(name string) string {
+	for _, s := range sidecarSuffixes {
+		if strings.HasSuffix(name, s) {
+			return s
+		}
+	}
+
+	return ""
+}
+
+type signatureURLBuilder interface {
+	SignatureURL(context.Context, Artifact) (string, error)
+	CertificateURL(context.Context, Artifact) (string, error)
+}
+
+// signedEndpoint is an endpoint which artifacts are verified by their detached signatures
+type signedEndpoint struct {
+	Endpoint
+	checker *signature.Checker
+	sig     *template.Template
+	cert    *template.Template
+}
+
+func newSignedEndpoint(endp Endpoint, name string, cfg config.SignatureSettings, log logrus.FieldLogger) (Endpoint, error) {
+	checker, err := signature.NewChecker(cfg, log)
+	if err != nil {
+		return nil, fmt.Errorf("endpoint %q: %v", name, err)
+	}
+	if !checker.Enabled() {
+		return endp, nil
+	}
+
+	e := &signedEndpoint{Endpoint: endp, checker: checker}
+	if len(cfg.SignatureURL) > 0 {
+		if e.sig, err = template.New(name + signatureSuffix).Option("missingkey=error").Parse(cfg.SignatureURL); err != nil {
+			return nil, fmt.Errorf("endpoint %q: invalid signature url template: %v", name, err)
+		}
+	}
+	if len(cfg.CertificateURL) > 0 {
+		if e.cert, err = template.New(name + certificateSuffix).Option("missingkey=error").Parse(cfg.CertificateURL); err != nil {
+			return nil, fmt.Errorf("endpoint %q: invalid certificate url template: %v", name, err)
+		}
+	}
+
+	return e, nil
+}
+
+func (e *signedEndpoint) SignatureURL(ctx context.Context, a Artifact) (string, error) {
+	return e.sidecarURL(ctx, e.sig, a, signatureSuffix)
+}
+
+func (e *signedEndpoint) CertificateURL(ctx context.Context, a Artifact) (string, error) {
+	return e.sidecarURL(ctx, e.cert, a, certificateSuffix)
+}
+
+// sidecarURL defaults to the file URL with the suffix
+func (e *signedEndpoint) sidecarURL(ctx context.Context, tmpl *template.Template, a Artifact, suffix string) (string, error) {
+	if tmpl != nil {
+		return execute(tmpl, a)
+	}
+
+	u, err := e.FileURL(ctx, a)
+	if err != nil {
+		return "", err
+	}
+
+	return u + suffix, nil
+}
+
+// checkerOf returns the signature checker of the endpoint, it's nil if signatures are not verified
+func checkerOf(endp Endpoint) *signature.Checker {
+	if e, ok := endp.(*signedEndpoint); ok {
+		return e.checker
+	}
+
+	return nil
+}
+
+// fetchSignature downloads the signature and the signing certificate of the artifact,
+// the certificate is optional as gpg signatures and sigstore bundles do not need it
+func (s source) fetchSignature(ctx context.Context, a Artifact) (signature.Material, error) {
+	var m signature.Material
+
+	urls, ok := s.urls.(signatureURLBuilder)
+	if !ok {
+		return m, errors.New("signatures are not supported")
+	}
+
+	sigURL, err := urls.SignatureURL(ctx, a)
+	if err != nil {
+		return m, err
+	}
+	if m.Signature, err = s.fetchSidecar(ctx, sigURL); err != nil {
+		return m, fmt.Errorf("fetch signature: %w", err)
+	}
+
+	certURL, err := urls.CertificateURL(ctx, a)
+	if err != nil {
+		return m, err
+	}
+	if m.Certificate, err = s.fetchSidecar(ctx, certURL); err != nil {
+		var e *httpError
+		if !errors.As(err, &e) || e.status != http.StatusNotFound {
+			return m, fmt.Errorf("fetch certificate: %w", err)
+		}
+	}
+
+	return m, nil
+}
+
+func (s source) fetchSidecar(ctx context.Context, url string) ([]byte, error) {
+	resp, err := s.download(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	return io.ReadAll(io.LimitReader(resp.Body, maxSignatureSize))
+}
+
+// writeSignature stores the verified signature next to the artifact, so it can be served to nodes and proxies
+func writeSignature(filePath string, m signature.Material) error {
+	if err := writeFileAtomic(filePath+signatureSuffix, m.Signature, 0644); err != nil {
+		return err
+	}
+
+	if len(m.Certificate) == 0 {
+		return nil
+	}
+
+	return writeFileAtomic(filePath+certificateSuffix, m.Certificate, 0644)
+}
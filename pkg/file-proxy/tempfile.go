@@ -0,0 +1,149 @@
+/*
+ Copyright (c) 2024 Alexey Shulutkov <github@shulutkov.ru>
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this File except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package fileproxy
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const tempFileSuffix = ".tmp"
+
+// tempFile is written next to its destination and renamed into place on commit,
+// so the destination is either absent or complete even if the process is killed
+type tempFile struct {
+	*os.File
+	dst       string
+	committed bool
+}
+
+func createTemp(dst string) (*tempFile, error) {
+	dir := filepath.Dir(dst)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	f, err := os.CreateTemp(dir, "."+filepath.Base(dst)+".*"+tempFileSuffix)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tempFile{File: f, dst: dst}, nil
+}
+
+// commit flushes the file to disk and renames it to the destination
+func (f *tempFile) commit(perm os.FileMode) error {
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Chmod(perm); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), f.dst); err != nil {
+		return err
+	}
+	f.committed = true
+
+	return syncDir(filepath.Dir(f.dst))
+}
+
+// discard removes the file unless it has been committed
+func (f *tempFile) discard() {
+	if f.committed {
+		return
+	}
+
+	_ = f.Close()
+	_ = os.Remove(f.Name())
+}
+
+func writeFileAtomic(dst string, data []byte, perm os.FileMode) error {
+	f, err := createTemp(dst)
+	if err != nil {
+		return err
+	}
+	defer f.discard()
+
+	if _, err = f.Write(data); err != nil {
+		return err
+	}
+
+	return f.commit(perm)
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = d.Close() }()
+
+	return d.Sync()
+}
+
+func isTempFile(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.HasSuffix(name, tempFileSuffix)
+}
+
+// PrepareCache must be called before the proxy starts serving requests, it moves artifacts cached
+// in the legacy layout, removes temporary files left by interrupted downloads and sets the cache size metrics
+func (p *Proxy) PrepareCache() error {
+	if err := p.migrateLegacyLayout(); err != nil {
+		return err
+	}
+	if err := p.removeTempFiles(); err != nil {
+		return err
+	}
+
+	entries, err := p.Entries()
+	if err != nil {
+		return err
+	}
+	images, err := p.registryEntries()
+	if err != nil {
+		return err
+	}
+	p.metrics.setCache(entries, images)
+
+	return nil
+}
+
+// removeTempFiles removes temporary files left by interrupted downloads
+func (p *Proxy) removeTempFiles() error {
+	err := filepath.WalkDir(p.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.Type().IsRegular() && isTempFile(d.Name()) {
+			p.log.Infof("remove orphaned temporary file %s", path)
+			return os.Remove(path)
+		}
+
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
@@ -0,0 +1,152 @@
+/*
+ Copyright (c) 2024 Alexey Shulutkov <github@shulutkov.ru>
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this File except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package fileproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/ks-tool/k8s-bootstrapper/internal/config"
+)
+
+// Template is an endpoint with download URLs built from Go templates,
+// e.g. https://nexus.local/repository/raw/{{.Name}}/{{.Version}}/{{.OS}}/{{.Arch}}/{{.Name}}
+type Template struct {
+	file     *template.Template
+	hashFile *template.Template
+	lastTag  config.LastTagSettings
+}
+
+func NewTemplate(cfg config.EndpointSettings) (*Template, error) {
+	if len(cfg.Name) == 0 {
+		return nil, errors.New("endpoint name is empty")
+	}
+
+	file, err := template.New(cfg.Name).Option("missingkey=error").Parse(cfg.FileURL)
+	if err != nil {
+		return nil, fmt.Errorf("endpoint %q: invalid file url template: %v", cfg.Name, err)
+	}
+
+	hashFile, err := template.New(cfg.Name + hashFileSuffix).Option("missingkey=error").Parse(cfg.HashFileURL)
+	if err != nil {
+		return nil, fmt.Errorf("endpoint %q: invalid hash file url template: %v", cfg.Name, err)
+	}
+
+	if len(cfg.LastTag.Value) == 0 && len(cfg.LastTag.URL) == 0 {
+		return nil, fmt.Errorf("endpoint %q: last tag source is not defined", cfg.Name)
+	}
+
+	return &Template{
+		file:     file,
+		hashFile: hashFile,
+		lastTag:  cfg.LastTag,
+	}, nil
+}
+
+func (t *Template) FileURL(_ context.Context, a Artifact) (string, error) {
+	return execute(t.file, a)
+}
+
+func (t *Template) HashFileURL(_ context.Context, a Artifact) (string, error) {
+	return execute(t.hashFile, a)
+}
+
+func (t *Template) LastTag(ctx context.Context) (string, error) {
+	if len(t.lastTag.Value) > 0 {
+		return t.lastTag.Value, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	resp, err := get(ctx, t.lastTag.URL)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("fetch last tag failed: expected 200 response code, got %d", resp.StatusCode)
+	}
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	if len(t.lastTag.JSONPath) == 0 {
+		return strings.TrimSpace(string(b)), nil
+	}
+
+	var doc any
+	if err = json.Unmarshal(b, &doc); err != nil {
+		return "", fmt.Errorf("fetch last tag failed: %v", err)
+	}
+
+	return lookupJSONPath(doc, t.lastTag.JSONPath)
+}
+
+func execute(tmpl *template.Template, a Artifact) (string, error) {
+	buf := new(bytes.Buffer)
+	if err := tmpl.Execute(buf, a); err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
+
+// lookupJSONPath returns the string value by a dot separated path like "data.0.version".
+// A leading "$." as in JSONPath expressions is allowed.
+func lookupJSONPath(doc any, p string) (string, error) {
+	p = strings.TrimPrefix(strings.TrimPrefix(p, "$"), ".")
+
+	v := doc
+	for _, key := range strings.Split(p, ".") {
+		switch node := v.(type) {
+		case map[string]any:
+			var ok bool
+			if v, ok = node[key]; !ok {
+				return "", fmt.Errorf("json path %q: key %q not found", p, key)
+			}
+		case []any:
+			idx, err := strconv.Atoi(key)
+			if err != nil || idx < 0 || idx >= len(node) {
+				return "", fmt.Errorf("json path %q: invalid index %q", p, key)
+			}
+			v = node[idx]
+		default:
+			return "", fmt.Errorf("json path %q: %q is not an object or array", p, key)
+		}
+	}
+
+	switch val := v.(type) {
+	case string:
+		return strings.TrimSpace(val), nil
+	case float64, bool:
+		return fmt.Sprint(val), nil
+	default:
+		return "", fmt.Errorf("json path %q: value is not a string", p)
+	}
+}
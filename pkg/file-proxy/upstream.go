@@ -0,0 +1,201 @@
+/*
+ Copyright (c) 2024 Alexey Shulutkov <github@shulutkov.ru>
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this File except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package fileproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"time"
+
+	"github.com/ks-tool/k8s-bootstrapper/internal/config"
+	"github.com/ks-tool/k8s-bootstrapper/pkg/signature"
+)
+
+const originSourceName = "origin"
+
+// originClient downloads artifacts and versions from origins of endpoints
+var originClient = &http.Client{Transport: newTransport(config.DefaultUpstreamTimeout)}
+
+type urlBuilder interface {
+	FileURL(context.Context, Artifact) (string, error)
+	HashFileURL(context.Context, Artifact) (string, error)
+}
+
+// upstream is a mirror with the same layout as the proxy, e.g. another k8s-bootstrapper proxy
+type upstream struct {
+	url       string
+	artifacts []string
+	client    *http.Client
+}
+
+func newUpstream(cfg config.UpstreamSettings) (*upstream, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream url %q: %v", cfg.URL, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid upstream url %q: unsupported scheme %q", cfg.URL, u.Scheme)
+	}
+
+	tr := newTransport(cfg.Timeout.Duration)
+
+	var rt http.RoundTripper = tr
+	if len(cfg.TokenFile) > 0 {
+		token, err := ReadTokenFile(cfg.TokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("upstream %q: %v", cfg.URL, err)
+		}
+		rt = &authTransport{auth: "Bearer " + token, next: tr}
+	}
+
+	return &upstream{
+		url:       u.String(),
+		artifacts: cfg.Artifacts,
+		client:    &http.Client{Transport: rt},
+	}, nil
+}
+
+// newTransport returns the transport limiting connecting and waiting for response headers,
+// the body is not limited as artifacts may be large
+func newTransport(timeout time.Duration) *http.Transport {
+	dialer := &net.Dialer{Timeout: timeout}
+
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.DialContext = dialer.DialContext
+	tr.TLSHandshakeTimeout = timeout
+	tr.ResponseHeaderTimeout = timeout
+
+	return tr
+}
+
+func (u *upstream) serves(name string) bool {
+	return len(u.artifacts) == 0 || slices.Contains(u.artifacts, name)
+}
+
+func (u *upstream) FileURL(_ context.Context, a Artifact) (string, error) {
+	return u.artifactURL(a.Name, a.Version, a)
+}
+
+func (u *upstream) HashFileURL(_ context.Context, a Artifact) (string, error) {
+	return u.artifactURL(a.Name, a.Version+hashFileSuffix, a)
+}
+
+func (u *upstream) SignatureURL(_ context.Context, a Artifact) (string, error) {
+	return u.artifactURL(a.Name, a.Version+signatureSuffix, a)
+}
+
+func (u *upstream) CertificateURL(_ context.Context, a Artifact) (string, error) {
+	return u.artifactURL(a.Name, a.Version+certificateSuffix, a)
+}
+
+func (u *upstream) artifactURL(name, version string, a Artifact) (string, error) {
+	s, err := url.JoinPath(u.url, name, version)
+	if err != nil {
+		return "", err
+	}
+
+	if q := a.Query(); len(q) > 0 {
+		s += "?" + q.Encode()
+	}
+
+	return s, nil
+}
+
+// source is a place where an artifact and its checksum are downloaded from
+type source struct {
+	name    string
+	urls    urlBuilder
+	client  *http.Client
+	checker *signature.Checker
+}
+
+// sources returns upstreams serving the artifact in the configured order followed by the origin endpoint
+func (p *Proxy) sources(endp Endpoint, name string) []source {
+	checker := checkerOf(endp)
+	srcs := make([]source, 0, len(p.upstreams)+1)
+	for _, u := range p.upstreams {
+		if u.serves(name) {
+			srcs = append(srcs, source{name: u.url, urls: u, client: u.client, checker: checker})
+		}
+	}
+
+	return append(srcs, source{name: originSourceName, urls: endp, client: originClient, checker: checker})
+}
+
+// fetch downloads the artifact and its checksum trying sources one by one,
+// it returns the name of the source which served the artifact
+func (p *Proxy) fetch(ctx context.Context, endp Endpoint, a Artifact, c *call) (string, error) {
+	var err error
+	for _, src := range p.sources(endp, a.Name) {
+		start := time.Now()
+		err = p.trackCacheSize(a, func() error { return src.fetch(ctx, a, p.filePath(a), c) })
+		if err == nil {
+			p.metrics.downloadTime.WithLabelValues(src.name).Observe(time.Since(start).Seconds())
+			p.log.Infof("%s served by %s", a, src.name)
+			return src.name, nil
+		}
+
+		if ctx.Err() != nil {
+			return "", err
+		}
+
+		p.metrics.failures.WithLabelValues(src.name).Inc()
+		if errors.Is(err, ErrChecksumMismatch) {
+			p.metrics.mismatches.WithLabelValues(src.name).Inc()
+		}
+
+		p.log.Warnf("fetch %s from %s failed: %v", a, src.name, err)
+	}
+
+	return "", err
+}
+
+func (s source) fetch(ctx context.Context, a Artifact, filePath string, c *call) error {
+	fileURL, err := s.urls.FileURL(ctx, a)
+	if err != nil {
+		return err
+	}
+
+	hashURL, err := s.urls.HashFileURL(ctx, a)
+	if err != nil {
+		return err
+	}
+
+	checksum, err := s.fetchHash(ctx, hashURL, path.Base(fileURL))
+	if err != nil {
+		return err
+	}
+
+	var sig *signature.Material
+	if s.checker.Enabled() {
+		m, err := s.fetchSignature(ctx, a)
+		if err = s.checker.Check(a.String(), err); err != nil {
+			return err
+		}
+		if len(m.Signature) > 0 {
+			sig = &m
+		}
+	}
+
+	return s.fetchFile(ctx, fileURL, filePath, checksum, sig, c)
+}
@@ -0,0 +1,222 @@
+/*
+ Copyright (c) 2024 Alexey Shulutkov <github@shulutkov.ru>
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this File except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package fileproxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/util/version"
+)
+
+const (
+	aliasLatest = "latest"
+	aliasStable = "stable"
+
+	// staleRetryInterval limits refreshes of stale values while the endpoint is unreachable
+	staleRetryInterval = time.Minute
+)
+
+// cachedEndpoint caches the latest version and the version list of the endpoint
+type cachedEndpoint struct {
+	Endpoint
+	lastTag  cachedValue[string]
+	versions cachedValue[[]string]
+}
+
+func newCachedEndpoint(endp Endpoint, name string, ttl time.Duration, log logrus.FieldLogger) *cachedEndpoint {
+	log = log.WithField("endpoint", name)
+	return &cachedEndpoint{
+		Endpoint: endp,
+		lastTag:  cachedValue[string]{ttl: ttl, log: log.WithField("cache", "last tag")},
+		versions: cachedValue[[]string]{ttl: ttl, log: log.WithField("cache", "versions")},
+	}
+}
+
+func (e *cachedEndpoint) LastTag(ctx context.Context) (string, error) {
+	return e.lastTag.get(ctx, e.Endpoint.LastTag)
+}
+
+// Versions lists versions of the endpoint, it's the latest version if the endpoint is not a VersionLister
+func (e *cachedEndpoint) Versions(ctx context.Context) ([]string, error) {
+	return e.versions.get(ctx, func(ctx context.Context) ([]string, error) {
+		if vl, ok := e.Endpoint.(VersionLister); ok {
+			return vl.Versions(ctx)
+		}
+
+		tag, err := e.LastTag(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		return []string{tag}, nil
+	})
+}
+
+// cachedValue is a value cached for ttl, the expired value is returned while it's refreshed in background
+type cachedValue[T any] struct {
+	ttl time.Duration
+	log logrus.FieldLogger
+
+	mu         sync.Mutex
+	value      T
+	ok         bool
+	expires    time.Time
+	refreshing bool
+	loading    *pendingValue[T]
+}
+
+// pendingValue is the first fetch of the value shared by concurrent callers
+type pendingValue[T any] struct {
+	done  chan struct{}
+	value T
+	err   error
+}
+
+// get returns the cached value. The first fetch is shared by concurrent callers and is not bound
+// to their contexts, a caller stops waiting for it when its context is done.
+func (c *cachedValue[T]) get(ctx context.Context, fetch func(context.Context) (T, error)) (T, error) {
+	c.mu.Lock()
+	if c.ok {
+		if time.Now().After(c.expires) && !c.refreshing {
+			c.refreshing = true
+			go c.refresh(context.WithoutCancel(ctx), fetch)
+		}
+		v := c.value
+		c.mu.Unlock()
+
+		return v, nil
+	}
+
+	p := c.loading
+	if p == nil {
+		p = &pendingValue[T]{done: make(chan struct{})}
+		c.loading = p
+		go c.load(context.WithoutCancel(ctx), p, fetch)
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-p.done:
+		return p.value, p.err
+	case <-ctx.Done():
+		var zero T
+		return zero, ctx.Err()
+	}
+}
+
+func (c *cachedValue[T]) load(ctx context.Context, p *pendingValue[T], fetch func(context.Context) (T, error)) {
+	p.value, p.err = fetch(ctx)
+
+	c.mu.Lock()
+	c.loading = nil
+	if p.err == nil {
+		c.set(p.value)
+	}
+	c.mu.Unlock()
+
+	close(p.done)
+}
+
+func (c *cachedValue[T]) refresh(ctx context.Context, fetch func(context.Context) (T, error)) {
+	v, err := fetch(ctx)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.refreshing = false
+	if err != nil {
+		c.log.Warnf("refresh failed, stale value is served: %v", err)
+		c.expires = time.Now().Add(min(c.ttl, staleRetryInterval))
+		return
+	}
+
+	c.set(v)
+}
+
+// cached reports whether the value has been fetched
+func (c *cachedValue[T]) cached() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.ok
+}
+
+func (c *cachedValue[T]) set(v T) {
+	c.value, c.ok = v, true
+	c.expires = time.Now().Add(c.ttl)
+}
+
+// isAlias reports whether the version is an alias: latest, stable, latest-<constraint>, stable-<constraint>
+// or a constraint starting with an operator, e.g. ~3.5 or >=1.30,<1.32
+func isAlias(v string) bool {
+	for _, alias := range []string{aliasLatest, aliasStable} {
+		if v == alias || strings.HasPrefix(v, alias+"-") {
+			return true
+		}
+	}
+
+	return len(v) > 0 && strings.ContainsRune("=!<>~^", rune(v[0]))
+}
+
+// resolveAlias returns the version of the alias. latest and stable are the latest version of the endpoint,
+// other aliases are the newest release matching the version constraint, e.g. stable-1.30, latest-3.5 or ~3.5,
+// from the version list of the endpoint. Pre-releases are not listed by endpoints.
+func resolveAlias(ctx context.Context, endp Endpoint, alias string) (string, error) {
+	if alias == aliasLatest || alias == aliasStable {
+		return endp.LastTag(ctx)
+	}
+
+	expr := alias
+	for _, prefix := range []string{aliasLatest + "-", aliasStable + "-"} {
+		expr = strings.TrimPrefix(expr, prefix)
+	}
+
+	c, err := ParseConstraint(expr)
+	if err != nil {
+		return "", &httpError{status: http.StatusBadRequest, error: fmt.Errorf("invalid version alias %q: %v", alias, err)}
+	}
+
+	versions, err := endpointVersions(ctx, endp)
+	if err != nil {
+		return "", err
+	}
+
+	latest, ok := c.Latest(versions)
+	if !ok {
+		return "", &httpError{status: http.StatusNotFound, error: fmt.Errorf("no release matches version alias %q", alias)}
+	}
+
+	return latest, nil
+}
+
+// sameRelease reports whether the first depth components of versions are equal
+func sameRelease(v, want *version.Version, depth int) bool {
+	a, b := v.Components(), want.Components()
+	for i := 0; i < depth && i < len(b); i++ {
+		if i >= len(a) || a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
@@ -30,17 +30,20 @@ type Flow struct {
 }
 
 func New() *Flow {
+	tty := isTerminal(os.Stderr)
+
 	return &Flow{
 		t: make([]Task, 0),
 		log: &Logger{
 			Logger: &log.Logger{
 				Out:          os.Stderr,
-				Formatter:    new(plainFormatter),
+				Formatter:    &plainFormatter{tty: tty},
 				Hooks:        make(log.LevelHooks),
 				Level:        log.InfoLevel,
 				ExitFunc:     os.Exit,
 				ReportCaller: false,
 			},
+			tty: tty,
 		},
 	}
 }
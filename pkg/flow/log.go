@@ -17,12 +17,18 @@ limitations under the License.
 package flow
 
 import (
+	"os"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
-type plainFormatter struct{}
+// clearLine erases the progress line the cursor was returned to
+const clearLine = "\033[K"
+
+type plainFormatter struct {
+	tty bool
+}
 
 func (f *plainFormatter) Format(entry *log.Entry) ([]byte, error) {
 	sep := ": "
@@ -31,12 +37,49 @@ func (f *plainFormatter) Format(entry *log.Entry) ([]byte, error) {
 	}
 
 	msg := []byte(entry.Time.Format(time.TimeOnly) + sep + entry.Message)
+	if f.tty {
+		msg = append([]byte(clearLine), msg...)
+	}
 
 	return append(msg, '\n'), nil
 }
 
-type Logger struct{ *log.Logger }
+type Logger struct {
+	*log.Logger
+	tty bool
+}
 
 func (l *Logger) Plain(msg string) {
+	if l.tty {
+		msg = clearLine + msg
+	}
 	_, _ = l.Out.Write(append([]byte(msg), '\n'))
 }
+
+// Progress renders the progress of the running action. On a terminal the line is redrawn
+// until the progress is done, otherwise it's logged at the debug level and at the info level once done.
+func (l *Logger) Progress(msg string, done bool) {
+	if !l.tty {
+		if done {
+			l.Info(msg)
+		} else {
+			l.Debug(msg)
+		}
+		return
+	}
+
+	line := clearLine + time.Now().Format(time.TimeOnly) + ": " + msg
+	if done {
+		line += "\n"
+	} else {
+		line += "\r"
+	}
+
+	_, _ = l.Out.Write([]byte(line))
+}
+
+// isTerminal reports whether the file is a character device, e.g. a terminal
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
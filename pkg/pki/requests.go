@@ -134,6 +134,64 @@ func (r *CertRequest) LoadCA() (*CA, error) {
 	return &CA{key: pk, cert: crt}, nil
 }
 
+// KeyFilepath returns the path of the private key
+func (r *CertRequest) KeyFilepath() string {
+	return r.keyCertFile(keyExt)
+}
+
+// CertFilepath returns the path of the certificate
+func (r *CertRequest) CertFilepath() string {
+	return r.keyCertFile(certExt)
+}
+
+// CAFilepath returns the path of the CA certificate, it's the certificate itself for a CA request
+func (r *CertRequest) CAFilepath() string {
+	if len(r.CAName) == 0 {
+		return r.keyCertFile(certExt)
+	}
+
+	return r.caFile(certExt)
+}
+
+// Ensure creates the private key and the certificate unless they exist, it reports whether the certificate was created.
+// The key and the certificate are stored at KeyFilepath and CertFilepath.
+func (r *CertRequest) Ensure() (bool, error) {
+	if err := os.MkdirAll(r.PkiDir, 0755); err != nil {
+		return false, err
+	}
+
+	pk, err := r.PrivateKey()
+	if err != nil {
+		return false, err
+	}
+
+	if pk.IsNew() {
+		if err = pk.Save(""); err != nil {
+			return false, err
+		}
+	}
+
+	certFile := pk.CertificateFilepath()
+	if _, err = os.Stat(certFile); err == nil {
+		if !pk.IsNew() {
+			return false, nil
+		}
+	} else if !os.IsNotExist(err) {
+		return false, err
+	}
+
+	crt, err := pk.CertificateSign(r)
+	if err != nil {
+		return false, fmt.Errorf("failed to sign certificate: %s", err)
+	}
+
+	if err = crt.Save(certFile); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
 func (r *PublicKeyRequest) PrivateKey() (*PrivateKey, error) {
 	return privateKey(r.privatePublicKeyFile(keyExt))
 }
@@ -0,0 +1,94 @@
+/*
+Copyright © 2024 Alexey Shulutkov <github@shulutkov.ru>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package signature
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+)
+
+const armorHeader = "-----BEGIN PGP"
+
+// GPG verifies detached signatures, binary or armored, made by keys of the key ring
+type GPG struct {
+	keyring openpgp.EntityList
+}
+
+func NewGPG(keyRing string) (*GPG, error) {
+	if len(keyRing) == 0 {
+		return nil, errors.New("gpg key ring is not defined")
+	}
+
+	b, err := os.ReadFile(keyRing)
+	if err != nil {
+		return nil, err
+	}
+
+	var keyring openpgp.EntityList
+	if bytes.HasPrefix(bytes.TrimSpace(b), []byte(armorHeader)) {
+		keyring, err = openpgp.ReadArmoredKeyRing(bytes.NewReader(b))
+	} else {
+		keyring, err = openpgp.ReadKeyRing(bytes.NewReader(b))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("key ring %q: %v", keyRing, err)
+	}
+
+	return &GPG{keyring: keyring}, nil
+}
+
+func (g *GPG) Begin(m Material) (Verification, error) {
+	if len(m.Signature) == 0 {
+		return nil, errors.New("signature is missing")
+	}
+
+	check := openpgp.CheckDetachedSignature
+	if bytes.HasPrefix(bytes.TrimSpace(m.Signature), []byte(armorHeader)) {
+		check = openpgp.CheckArmoredDetachedSignature
+	}
+
+	// the content is streamed to the library through a pipe
+	pr, pw := io.Pipe()
+	v := &gpgVerification{pw: pw, done: make(chan error, 1)}
+	go func() {
+		_, err := check(g.keyring, pr, bytes.NewReader(m.Signature), nil)
+		// unblocks writes if the signature has been rejected before the content is read
+		_ = pr.Close()
+		v.done <- err
+	}()
+
+	return v, nil
+}
+
+type gpgVerification struct {
+	pw   *io.PipeWriter
+	done chan error
+}
+
+func (v *gpgVerification) Write(p []byte) (int, error) {
+	return v.pw.Write(p)
+}
+
+func (v *gpgVerification) Verify() error {
+	_ = v.pw.Close()
+	return <-v.done
+}
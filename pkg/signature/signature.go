@@ -0,0 +1,195 @@
+/*
+Copyright © 2024 Alexey Shulutkov <github@shulutkov.ru>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package signature
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/ks-tool/k8s-bootstrapper/internal/config"
+
+	"github.com/sirupsen/logrus"
+)
+
+type Policy string
+
+const (
+	PolicyRequire Policy = "require"
+	PolicyWarn    Policy = "warn"
+	PolicyOff     Policy = "off"
+
+	TypeSigstore = "sigstore"
+	TypeGPG      = "gpg"
+)
+
+var ErrVerification = errors.New("signature verification failed")
+
+// Material is the detached signature of an artifact, the certificate is used by sigstore signatures only
+type Material struct {
+	Signature   []byte
+	Certificate []byte
+}
+
+// Verifier checks signatures of the content written to a verification
+type Verifier interface {
+	Begin(m Material) (Verification, error)
+}
+
+type Verification interface {
+	io.Writer
+	// Verify checks the signature of the written content, it's called once
+	Verify() error
+}
+
+func NewVerifier(cfg config.SignatureSettings) (Verifier, error) {
+	switch cfg.Type {
+	case "", TypeSigstore:
+		return NewSigstore(cfg.TrustedRoot, cfg.Identities, cfg.Issuer, cfg.AllowExpiredCertificates)
+	case TypeGPG:
+		return NewGPG(cfg.KeyRing)
+	default:
+		return nil, fmt.Errorf("unknown signature type %q", cfg.Type)
+	}
+}
+
+// Checker verifies signatures according to the policy, a nil checker means the policy is off
+type Checker struct {
+	policy   Policy
+	verifier Verifier
+	log      logrus.FieldLogger
+}
+
+func NewChecker(cfg config.SignatureSettings, log logrus.FieldLogger) (*Checker, error) {
+	policy := Policy(cfg.Policy)
+	switch policy {
+	case "", PolicyOff:
+		return nil, nil
+	case PolicyRequire, PolicyWarn:
+	default:
+		return nil, fmt.Errorf("unknown signature policy %q", cfg.Policy)
+	}
+
+	v, err := NewVerifier(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Checker{policy: policy, verifier: v, log: log}, nil
+}
+
+func (c *Checker) Enabled() bool {
+	return c != nil
+}
+
+// Check applies the policy to the verification error of subject,
+// the error is logged and nil is returned if the policy is warn
+func (c *Checker) Check(subject string, err error) error {
+	if c == nil || err == nil {
+		return nil
+	}
+
+	err = fmt.Errorf("%s: %w: %v", subject, ErrVerification, err)
+	if c.policy == PolicyWarn {
+		c.log.Warn(err)
+		return nil
+	}
+
+	return err
+}
+
+// VerifyFile verifies the signature of the file, the policy is not applied
+func (c *Checker) VerifyFile(file string, m Material) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+
+	v, err := c.verifier.Begin(m)
+	if err != nil {
+		return err
+	}
+
+	if _, err = io.Copy(v, f); err != nil {
+		_ = v.Verify()
+		return err
+	}
+
+	return v.Verify()
+}
+
+// Reader verifies the content read through it and returns the error
+// of the policy check instead of io.EOF
+type Reader struct {
+	r       io.Reader
+	v       Verification
+	c       *Checker
+	subject string
+	done    bool
+	err     error
+}
+
+// NewReader returns the reader verifying the content of subject read from r
+func (c *Checker) NewReader(r io.Reader, subject string, m Material) (*Reader, error) {
+	vr := &Reader{r: r, c: c, subject: subject}
+	if c == nil {
+		return vr, nil
+	}
+
+	v, err := c.verifier.Begin(m)
+	if err != nil {
+		if err = c.Check(subject, err); err != nil {
+			return nil, err
+		}
+		return vr, nil
+	}
+	vr.v = v
+
+	return vr, nil
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if r.v == nil {
+		return n, err
+	}
+
+	_, _ = r.v.Write(p[:n])
+	if err == io.EOF {
+		if !r.done {
+			r.done = true
+			r.err = r.c.Check(r.subject, r.v.Verify())
+		}
+		if r.err != nil {
+			return n, r.err
+		}
+	}
+
+	return n, err
+}
+
+// Close releases the verification if the content has not been read to the end
+func (r *Reader) Close() error {
+	if r.v != nil && !r.done {
+		r.done = true
+		_ = r.v.Verify()
+	}
+
+	return nil
+}
@@ -0,0 +1,309 @@
+/*
+Copyright © 2024 Alexey Shulutkov <github@shulutkov.ru>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package signature
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"os"
+	"slices"
+)
+
+var (
+	// OIDC issuer extensions of Fulcio certificates
+	oidIssuerV1 = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 1}
+	oidIssuerV2 = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 8}
+)
+
+// Sigstore verifies keyless signatures made by cosign, e.g. .sig and .cert files of Kubernetes releases,
+// or sigstore bundles. The transparency log is not consulted, so the certificate chain is checked now
+// unless allowExpired is set, then it's checked at the time the short-lived signing certificate was issued.
+type Sigstore struct {
+	roots         *x509.CertPool
+	intermediates *x509.CertPool
+	identities    []string
+	issuer        string
+	allowExpired  bool
+}
+
+func NewSigstore(trustedRoot string, identities []string, issuer string, allowExpired bool) (*Sigstore, error) {
+	if len(trustedRoot) == 0 {
+		return nil, errors.New("sigstore trusted root is not defined")
+	}
+	if len(identities) == 0 {
+		return nil, errors.New("sigstore identities are not defined")
+	}
+	if len(issuer) == 0 {
+		return nil, errors.New("sigstore issuer is not defined")
+	}
+
+	b, err := os.ReadFile(trustedRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	certs, err := parseTrustedRoot(b)
+	if err != nil {
+		return nil, fmt.Errorf("trusted root %q: %v", trustedRoot, err)
+	}
+
+	s := &Sigstore{
+		roots:         x509.NewCertPool(),
+		intermediates: x509.NewCertPool(),
+		identities:    identities,
+		issuer:        issuer,
+		allowExpired:  allowExpired,
+	}
+	for _, cert := range certs {
+		if bytes.Equal(cert.RawSubject, cert.RawIssuer) {
+			s.roots.AddCert(cert)
+		} else {
+			s.intermediates.AddCert(cert)
+		}
+	}
+
+	return s, nil
+}
+
+func (s *Sigstore) Begin(m Material) (Verification, error) {
+	cert, sig, err := parseSigstoreMaterial(m)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = s.verifyCertificate(cert); err != nil {
+		return nil, err
+	}
+
+	return &sigstoreVerification{Hash: sha256.New(), pub: cert.PublicKey, sig: sig}, nil
+}
+
+func (s *Sigstore) verifyCertificate(cert *x509.Certificate) error {
+	opts := x509.VerifyOptions{
+		Roots:         s.roots,
+		Intermediates: s.intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	}
+	if s.allowExpired {
+		opts.CurrentTime = cert.NotBefore
+	}
+
+	_, err := cert.Verify(opts)
+	if err != nil {
+		return err
+	}
+
+	ids := slices.Clone(cert.EmailAddresses)
+	for _, u := range cert.URIs {
+		ids = append(ids, u.String())
+	}
+	if !slices.ContainsFunc(ids, func(id string) bool { return slices.Contains(s.identities, id) }) {
+		return fmt.Errorf("certificate identity %v is not trusted", ids)
+	}
+
+	if issuer := certificateIssuer(cert); issuer != s.issuer {
+		return fmt.Errorf("certificate issuer %q is not trusted", issuer)
+	}
+
+	return nil
+}
+
+type sigstoreVerification struct {
+	hash.Hash
+	pub any
+	sig []byte
+}
+
+func (v *sigstoreVerification) Verify() error {
+	digest := v.Sum(nil)
+
+	switch pub := v.pub.(type) {
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(pub, digest, v.sig) {
+			return errors.New("invalid ecdsa signature")
+		}
+		return nil
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest, v.sig)
+	default:
+		return fmt.Errorf("unsupported public key type %T", pub)
+	}
+}
+
+// certificateIssuer returns the OIDC issuer of the Fulcio certificate
+func certificateIssuer(cert *x509.Certificate) string {
+	for _, ext := range cert.Extensions {
+		switch {
+		case ext.Id.Equal(oidIssuerV2):
+			var issuer string
+			if _, err := asn1.Unmarshal(ext.Value, &issuer); err == nil {
+				return issuer
+			}
+		case ext.Id.Equal(oidIssuerV1):
+			return string(ext.Value)
+		}
+	}
+
+	return ""
+}
+
+type rawBytes struct {
+	RawBytes []byte `json:"rawBytes"`
+}
+
+// sigstoreBundle is the part of a sigstore bundle used for verification of a blob signature
+type sigstoreBundle struct {
+	VerificationMaterial struct {
+		Certificate          *rawBytes `json:"certificate"`
+		X509CertificateChain *struct {
+			Certificates []rawBytes `json:"certificates"`
+		} `json:"x509CertificateChain"`
+	} `json:"verificationMaterial"`
+	MessageSignature *struct {
+		Signature []byte `json:"signature"`
+	} `json:"messageSignature"`
+}
+
+// parseSigstoreMaterial returns the signing certificate and the signature of a sigstore bundle
+// or of base64 encoded .sig and .cert files
+func parseSigstoreMaterial(m Material) (*x509.Certificate, []byte, error) {
+	if b := bytes.TrimSpace(m.Signature); len(b) > 0 && b[0] == '{' {
+		var bundle sigstoreBundle
+		if err := json.Unmarshal(b, &bundle); err != nil {
+			return nil, nil, fmt.Errorf("invalid sigstore bundle: %v", err)
+		}
+		if bundle.MessageSignature == nil {
+			return nil, nil, errors.New("sigstore bundle has no message signature")
+		}
+
+		var der []byte
+		vm := bundle.VerificationMaterial
+		switch {
+		case vm.Certificate != nil:
+			der = vm.Certificate.RawBytes
+		case vm.X509CertificateChain != nil && len(vm.X509CertificateChain.Certificates) > 0:
+			der = vm.X509CertificateChain.Certificates[0].RawBytes
+		default:
+			return nil, nil, errors.New("sigstore bundle has no certificate")
+		}
+
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return cert, bundle.MessageSignature.Signature, nil
+	}
+
+	if len(m.Certificate) == 0 {
+		return nil, nil, errors.New("signing certificate is missing")
+	}
+
+	certs, err := parseCertificates(decodeBase64(m.Certificate))
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(certs) == 0 {
+		return nil, nil, errors.New("signing certificate is missing")
+	}
+
+	return certs[0], decodeBase64(m.Signature), nil
+}
+
+// trustedRoot is the part of a sigstore trusted_root.json with certificate authorities
+type trustedRoot struct {
+	CertificateAuthorities []struct {
+		CertChain struct {
+			Certificates []rawBytes `json:"certificates"`
+		} `json:"certChain"`
+	} `json:"certificateAuthorities"`
+}
+
+func parseTrustedRoot(b []byte) ([]*x509.Certificate, error) {
+	if b = bytes.TrimSpace(b); len(b) == 0 || b[0] != '{' {
+		return parseCertificates(b)
+	}
+
+	var tr trustedRoot
+	if err := json.Unmarshal(b, &tr); err != nil {
+		return nil, err
+	}
+
+	var certs []*x509.Certificate
+	for _, ca := range tr.CertificateAuthorities {
+		for _, raw := range ca.CertChain.Certificates {
+			cert, err := x509.ParseCertificate(raw.RawBytes)
+			if err != nil {
+				return nil, err
+			}
+			certs = append(certs, cert)
+		}
+	}
+
+	if len(certs) == 0 {
+		return nil, errors.New("no certificate authorities found")
+	}
+
+	return certs, nil
+}
+
+// parseCertificates parses PEM encoded certificates
+func parseCertificates(b []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		if block, b = pem.Decode(b); block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+
+	if len(certs) == 0 {
+		return nil, errors.New("no certificates found")
+	}
+
+	return certs, nil
+}
+
+// decodeBase64 returns b decoded if it's base64 encoded as cosign output files are
+func decodeBase64(b []byte) []byte {
+	b = bytes.TrimSpace(b)
+	if dec, err := base64.StdEncoding.DecodeString(string(b)); err == nil {
+		return dec
+	}
+
+	return b
+}
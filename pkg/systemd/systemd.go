@@ -60,12 +60,31 @@ type UnitSection struct {
 
 type ServiceSection struct {
 	User            string `ini:",omitempty"`
+	Group           string `ini:",omitempty"`
 	Type            string `ini:",omitempty"`
 	Environment     string `ini:",omitempty"`
 	EnvironmentFile string `ini:",omitempty"`
 	ExecStart       string
 	Restart         string `ini:",omitempty"`
 	RestartSec      int    `ini:",omitempty"`
+
+	// sandboxing, see systemd.exec(5)
+	NoNewPrivileges         bool   `ini:",omitempty"`
+	ProtectSystem           string `ini:",omitempty"`
+	ProtectHome             string `ini:",omitempty"`
+	ReadWritePaths          string `ini:",omitempty"`
+	RuntimeDirectory        string `ini:",omitempty"`
+	PrivateTmp              bool   `ini:",omitempty"`
+	PrivateDevices          bool   `ini:",omitempty"`
+	ProtectKernelTunables   bool   `ini:",omitempty"`
+	ProtectKernelModules    bool   `ini:",omitempty"`
+	ProtectControlGroups    bool   `ini:",omitempty"`
+	RestrictNamespaces      bool   `ini:",omitempty"`
+	RestrictRealtime        bool   `ini:",omitempty"`
+	LockPersonality         bool   `ini:",omitempty"`
+	MemoryDenyWriteExecute  bool   `ini:",omitempty"`
+	RestrictAddressFamilies string `ini:",omitempty"`
+	SystemCallArchitectures string `ini:",omitempty"`
 }
 
 type InstallSection struct {
@@ -148,3 +167,13 @@ func NewSystemdUnitFromUnitFile(name string) (*SystemdUnit, error) {
 
 	return unit, nil
 }
+
+// RemoveUnit removes the unit file of the service, it's not an error if the file does not exist
+func RemoveUnit(serviceName string) error {
+	err := os.Remove(fmt.Sprintf(serviceUnitFileFormat, serviceName))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}